@@ -1,22 +1,166 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/containers/tar-diff/pkg/common"
 	"github.com/containers/tar-diff/pkg/tar-diff"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
 var version = flag.Bool("version", false, "Show version")
 var compressionLevel = flag.Int("compression-level", 3, "zstd compression level")
 var maxBsdiffSize = flag.Int("max-bsdiff-size", 192, "Max file size in megabytes to consider using bsdiff, or 0 for no limit")
+var frameSize = flag.Int("frame-size", 0, "Split the delta into independent frames of this many megabytes of output, or 0 for a single frame")
+var recordCompression = flag.Bool("record-compression", false, "Record how new.tar.gz was compressed, so tar-patch can recreate it")
+var recordSources = flag.Bool("record-sources", true, "Record the old files needed to apply the delta, for tar-patch check-sources")
+var transformExecutables = flag.Bool("transform-executables", false, "Normalize call targets in x86 and ARM64 ELF executables, when that gives a smaller delta")
+var maxSources = flag.Int("max-sources", 1, "Max number of old files to diff each new file against, for files combined from several old ones")
+var dedupWindow = flag.Int("dedup-window", 0, "Copy files that repeat content from up to this many megabytes earlier in new.tar.gz from the earlier output, or 0 to disable")
+var strongHash = flag.Bool("strong-hash", false, "Also compare rollsum blobs by sha256, so CRC collisions are not counted as matches (slower)")
+var chunker = flag.String("chunker", "rollsum", "How to split files into blobs for rollsums, rollsum or fastcdc (faster)")
+var minChunkSize = flag.Int("min-chunk-size", 0, "Min rollsum blob size in bytes")
+var avgChunkSize = flag.Int("avg-chunk-size", 8192, "Average rollsum blob size in bytes, rounded down to a power of two")
+var maxChunkSize = flag.Int("max-chunk-size", 32768, "Max rollsum blob size in bytes")
+var signatureCache = flag.String("signature-cache", "", "Directory to keep the analysis of old.tar.gz in, so diffing from the same old tarfile again is faster")
+var oldSignature = flag.String("old-signature", "", "Diff from a signature made by the signature command, instead of old.tar.gz")
+var progress = flag.Bool("progress", false, "Print the progress to stderr")
+var bestOf = flag.Bool("best-of", false, "Try all encodings for each changed file up to --max-bsdiff-size and use the smallest (slower)")
+var report = flag.Bool("report", false, "Print how each file in new.tar.gz was encoded")
+var sourceByDigest = flag.Bool("source-by-digest", false, "Reference old files by content digest instead of path (for tar-patch --cas)")
+
+// Loads the signature of oldFile from the cache directory, or analyzes
+// it and adds it to the cache. Signatures are keyed by the digest of the
+// file and the chunker options.
+func cachedSignature(ctx context.Context, oldFile *os.File, options *tar_diff.Options, cacheDir string) (*tar_diff.LayerSignature, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, oldFile); err != nil {
+		return nil, err
+	}
+	if _, err := oldFile.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s-%d-%d-%d", hex.EncodeToString(h.Sum(nil)), *chunker, *minChunkSize, *avgChunkSize, *maxChunkSize)
+	if *strongHash {
+		name += "-strong"
+	}
+	cachePath := filepath.Join(cacheDir, name+".sig")
+
+	if f, err := os.Open(cachePath); err == nil {
+		defer f.Close()
+		return tar_diff.LoadSignature(f)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	signature, err := tar_diff.AnalyzeTarContext(ctx, oldFile, options)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := oldFile.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	// Write to a temporary file first, so concurrent runs never see a partial signature
+	tmp, err := ioutil.TempFile(cacheDir, ".tmp-"+name)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tar_diff.SaveSignature(tmp, signature); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), cachePath); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// Prints a line for each phase, and at most one a second while it runs
+func printProgress() func(tar_diff.ProgressEvent) {
+	var phase tar_diff.ProgressPhase
+	var printed time.Time
+	return func(e tar_diff.ProgressEvent) {
+		end := e.Total != 0 && e.Bytes == e.Total
+		if e.Phase == phase && !end && time.Since(printed) < time.Second {
+			return
+		}
+		phase = e.Phase
+		printed = time.Now()
+		if e.Total != 0 {
+			fmt.Fprintf(os.Stderr, "%-12s %8.1f / %.1f MB (%d%%) %s\n", e.Phase, float64(e.Bytes)/(1024*1024), float64(e.Total)/(1024*1024), e.Bytes*100/e.Total, e.File)
+		} else {
+			fmt.Fprintf(os.Stderr, "%-12s %8.1f MB %s\n", e.Phase, float64(e.Bytes)/(1024*1024), e.File)
+		}
+	}
+}
+
+// Writes a signature of the files in a directory, for diffing against
+// without having the old tarfile
+func writeSignature(ctx context.Context, dir string, signatureFilename string, options *tar_diff.Options) error {
+	signature, err := tar_diff.AnalyzeFSContext(ctx, os.DirFS(dir), options)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(signatureFilename)
+	if err != nil {
+		return err
+	}
+	if err := tar_diff.SaveSignature(f, signature); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func diffFromSignature(ctx context.Context, signatureFilename string, newFilename string, deltaFilename string, options *tar_diff.Options) error {
+	f, err := os.Open(signatureFilename)
+	if err != nil {
+		return err
+	}
+	signature, err := tar_diff.LoadSignature(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	newFile, err := os.Open(newFilename)
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+
+	deltaFile, err := os.Create(deltaFilename)
+	if err != nil {
+		return err
+	}
+	if err := tar_diff.DiffWithSignatureContext(ctx, signature, nil, newFile, deltaFile, options); err != nil {
+		deltaFile.Close()
+		return err
+	}
+	return deltaFile.Close()
+}
 
 func main() {
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPION] old.tar.gz new.tar.gz result.tardiff\n", path.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPION] old.tar.gz|/path/to/old/content new.tar.gz result.tardiff\n", path.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [OPION] --old-signature old.sig new.tar.gz result.tardiff\n", path.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [OPION] signature /path/to/content result.sig\n", path.Base(os.Args[0]))
 		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
 		flag.PrintDefaults()
 	}
@@ -28,6 +172,63 @@ func main() {
 		return
 	}
 
+	options := tar_diff.NewOptions()
+	options.SetCompressionLevel(*compressionLevel)
+	options.SetMaxBsdiffFileSize(int64(*maxBsdiffSize) * 1024 * 1024)
+	options.SetRecordCompression(*recordCompression)
+	options.SetFrameSize(int64(*frameSize) * 1024 * 1024)
+	options.SetSourceByDigest(*sourceByDigest)
+	options.SetRecordSources(*recordSources)
+	options.SetTransformExecutables(*transformExecutables)
+	options.SetBestOf(*bestOf)
+	options.SetMaxSources(*maxSources)
+	options.SetDedupWindow(int64(*dedupWindow) * 1024 * 1024)
+	options.SetStrongHash(*strongHash)
+	options.SetChunker(tar_diff.Chunker(*chunker))
+	options.SetChunkSizes(int64(*minChunkSize), int64(*avgChunkSize), int64(*maxChunkSize))
+	if *progress {
+		options.SetProgress(printProgress())
+	}
+	if *report {
+		options.SetFileReport(func(r *tar_diff.FileReport) {
+			if r.SourcePath != "" && r.SourcePath != r.Path {
+				fmt.Printf("%-18s %10d %s (from %s)\n", r.Encoding, r.Size, r.Path, r.SourcePath)
+			} else {
+				fmt.Printf("%-18s %10d %s\n", r.Encoding, r.Size, r.Path)
+			}
+		})
+	}
+
+	// Stop on interrupt, so the temporary files are removed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if flag.Arg(0) == "signature" {
+		if flag.NArg() != 3 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		// Diffing from only a signature needs strong hashes
+		options.SetStrongHash(true)
+		if err := writeSignature(ctx, flag.Arg(1), flag.Arg(2), options); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error generating signature: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *oldSignature != "" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(1)
+		}
+		if err := diffFromSignature(ctx, *oldSignature, flag.Arg(0), flag.Arg(1), options); err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error generating delta: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if flag.NArg() != 3 {
 		flag.Usage()
 		os.Exit(1)
@@ -44,6 +245,16 @@ func main() {
 	}
 	defer oldFile.Close()
 
+	oldStat, err := oldFile.Stat()
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unable to open %s: %s\n", oldFilename, err)
+		os.Exit(1)
+	}
+	if oldStat.IsDir() && *signatureCache != "" {
+		fmt.Fprintf(flag.CommandLine.Output(), "--signature-cache can only be used with an old tarfile\n")
+		os.Exit(1)
+	}
+
 	newFile, err := os.Open(newFilename)
 	if err != nil {
 		fmt.Fprintf(flag.CommandLine.Output(), "Unable to open %s: %s\n", newFilename, err)
@@ -57,11 +268,20 @@ func main() {
 		os.Exit(1)
 	}
 
-	options := tar_diff.NewOptions()
-	options.SetCompressionLevel(*compressionLevel)
-	options.SetMaxBsdiffFileSize(int64(*maxBsdiffSize) * 1024 * 1024)
-
-	err = tar_diff.Diff(oldFile, newFile, deltaFile, options)
+	if oldStat.IsDir() {
+		// Diff from the files of an extracted old tarfile
+		err = tar_diff.DiffFSContext(ctx, os.DirFS(oldFilename), newFile, deltaFile, options)
+	} else if *signatureCache != "" {
+		var signature *tar_diff.LayerSignature
+		signature, err = cachedSignature(ctx, oldFile, options, *signatureCache)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error reading signature cache: %s\n", err)
+			os.Exit(1)
+		}
+		err = tar_diff.DiffWithSignatureContext(ctx, signature, oldFile, newFile, deltaFile, options)
+	} else {
+		err = tar_diff.DiffContext(ctx, oldFile, newFile, deltaFile, options)
+	}
 	if err != nil {
 		fmt.Fprintf(flag.CommandLine.Output(), "Error generating delta: %s\n", err)
 		os.Exit(1)
@@ -1,19 +1,141 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/containers/tar-diff/pkg/common"
 	"github.com/containers/tar-diff/pkg/tar-patch"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
+	"time"
 )
 
 var version = flag.Bool("version", false, "Show version")
+var compressed = flag.Bool("compressed", false, "Recreate the original compressed file (requires a delta made with --record-compression)")
+var parallel = flag.Int("parallel", 1, "Number of goroutines used to apply a delta made with --frame-size, or 0 for one per CPU")
+var cas = flag.Bool("cas", false, "The content is a content addressed store of files named objects/ab/cdef... by sha256 digest (requires a delta made with --source-by-digest)")
+var fallbackURL = flag.String("fallback-url", "", "URL of the new uncompressed tarfile, to fetch the parts that need missing or modified source files with HTTP range requests")
+var progress = flag.Bool("progress", false, "Print the progress to stderr")
+var resume = flag.Bool("resume", false, "Save checkpoints while applying, and resume from the last checkpoint if interrupted (requires a delta made with --frame-size)")
+
+func newDataSource(extractedDir string) tar_patch.DataSource {
+	// Keep recently used files open and buffer reads, as deltas often
+	// switch between files and do many small seeks and copies
+	options := tar_patch.NewFilesystemOptions()
+	options.SetMaxOpenFiles(64)
+	options.SetReadAhead(128 * 1024)
+	if *cas {
+		return tar_patch.NewCASDataSourceWithOptions(extractedDir, options)
+	}
+	return tar_patch.NewFilesystemDataSourceWithOptions(extractedDir, options)
+}
+
+// Prints the progress at most once a second, and when done
+func printProgress() func(tar_patch.ProgressEvent) {
+	var printed time.Time
+	return func(e tar_patch.ProgressEvent) {
+		if e.OutputBytes != e.TotalBytes && time.Since(printed) < time.Second {
+			return
+		}
+		printed = time.Now()
+		if e.TotalBytes != 0 {
+			fmt.Fprintf(os.Stderr, "%8.1f / %.1f MB (%d%%), %d ops\n", float64(e.OutputBytes)/(1024*1024), float64(e.TotalBytes)/(1024*1024), e.OutputBytes*100/e.TotalBytes, e.Ops)
+		} else {
+			fmt.Fprintf(os.Stderr, "%8.1f MB, %d ops\n", float64(e.OutputBytes)/(1024*1024), e.Ops)
+		}
+	}
+}
+
+func applyResumable(ctx context.Context, deltaFile *os.File, dataSource tar_patch.DataSource, patchedFilename string, options *tar_patch.ApplyOptions) error {
+	checkpointFilename := patchedFilename + ".checkpoint"
+
+	checkpoint, err := tar_patch.LoadCheckpoint(checkpointFilename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	patchedFile, err := os.OpenFile(patchedFilename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer patchedFile.Close()
+
+	// Drop anything written after the checkpoint
+	offset := int64(0)
+	if checkpoint != nil {
+		offset = checkpoint.OutputOffset
+	}
+	if err := patchedFile.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := patchedFile.Seek(offset, 0); err != nil {
+		return err
+	}
+
+	err = tar_patch.ApplyResumableContext(ctx, deltaFile, dataSource, patchedFile, checkpoint, func(c *tar_patch.Checkpoint) error {
+		// The output must be on disk before the checkpoint that refers to it
+		if err := patchedFile.Sync(); err != nil {
+			return err
+		}
+		return tar_patch.SaveCheckpoint(checkpointFilename, c)
+	}, options)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(checkpointFilename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return patchedFile.Close()
+}
+
+// Reports any missing or corrupted source files, returns false if there are any
+func checkSources(deltaFilename string, extractedDir string) (bool, error) {
+	deltaFile, err := os.Open(deltaFilename)
+	if err != nil {
+		return false, err
+	}
+	defer deltaFile.Close()
+
+	info, err := tar_patch.ReadDeltaInfo(deltaFile)
+	if err != nil {
+		return false, err
+	}
+	if len(info.Sources) == 0 {
+		return false, fmt.Errorf("%s has no list of source files", deltaFilename)
+	}
+
+	dataSource := newDataSource(extractedDir)
+	defer dataSource.Close()
+
+	bad := 0
+	for _, check := range tar_patch.CheckSources(info, dataSource) {
+		if check.Status == tar_patch.SourceOK {
+			continue
+		}
+		bad++
+		if check.Err != nil {
+			fmt.Printf("%s: %s (%s)\n", check.Status, check.Source.Path, check.Err)
+		} else {
+			fmt.Printf("%s: %s\n", check.Status, check.Source.Path)
+		}
+	}
+	if bad > 0 {
+		fmt.Printf("%d of %d source files missing or corrupted\n", bad, len(info.Sources))
+		return false, nil
+	}
+	fmt.Printf("All %d source files ok\n", len(info.Sources))
+	return true, nil
+}
 
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPION] file.tardiff /path/to/content destination.tar\n", path.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [OPION] check-sources file.tardiff /path/to/content\n", path.Base(os.Args[0]))
 		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
 		flag.PrintDefaults()
 	}
@@ -30,11 +152,23 @@ func main() {
 		os.Exit(1)
 	}
 
+	if flag.Arg(0) == "check-sources" {
+		ok, err := checkSources(flag.Arg(1), flag.Arg(2))
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error checking sources: %s\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
 	deltaFilename := flag.Arg(0)
 	extractedDir := flag.Arg(1)
 	patchedFilename := flag.Arg(2)
 
-	dataSource := tar_patch.NewFilesystemDataSource(extractedDir)
+	dataSource := newDataSource(extractedDir)
 	defer dataSource.Close()
 
 	deltaFile, err := os.Open(deltaFilename)
@@ -44,6 +178,36 @@ func main() {
 	}
 	defer deltaFile.Close()
 
+	if *fallbackURL != "" && (*resume || *compressed || *parallel != 1) {
+		fmt.Fprintf(flag.CommandLine.Output(), "--fallback-url can't be used with --resume, --compressed or --parallel\n")
+		os.Exit(1)
+	}
+
+	options := tar_patch.NewApplyOptions()
+	if *fallbackURL != "" {
+		options.SetFallbackFetcher(tar_patch.NewHTTPFallbackFetcher(*fallbackURL))
+	}
+	if *progress {
+		options.SetProgress(printProgress())
+	}
+
+	// Stop on interrupt, so that --resume can continue from the last checkpoint
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *resume {
+		if patchedFilename == "-" || *compressed {
+			fmt.Fprintf(flag.CommandLine.Output(), "--resume requires an uncompressed destination file\n")
+			os.Exit(1)
+		}
+		err = applyResumable(ctx, deltaFile, dataSource, patchedFilename, options)
+		if err != nil {
+			fmt.Fprintf(flag.CommandLine.Output(), "Error applying diff: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var patchedFile *os.File
 
 	if patchedFilename == "-" {
@@ -58,7 +222,20 @@ func main() {
 		defer patchedFile.Close()
 	}
 
-	err = tar_patch.Apply(deltaFile, dataSource, patchedFile)
+	if *compressed {
+		err = tar_patch.ApplyCompressedContext(ctx, deltaFile, dataSource, patchedFile, options)
+	} else if *parallel != 1 && patchedFilename != "-" {
+		var deltaInfo os.FileInfo
+		deltaInfo, err = deltaFile.Stat()
+		if err == nil {
+			newWorkerDataSource := func() (tar_patch.DataSource, error) {
+				return newDataSource(extractedDir), nil
+			}
+			err = tar_patch.ApplyParallelContext(ctx, deltaFile, deltaInfo.Size(), newWorkerDataSource, patchedFile, *parallel, options)
+		}
+	} else {
+		err = tar_patch.ApplyContext(ctx, deltaFile, dataSource, patchedFile, options)
+	}
 	if err != nil {
 		fmt.Fprintf(flag.CommandLine.Output(), "Error applying diff: %s\n", err)
 		os.Exit(1)
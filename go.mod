@@ -1,8 +1,17 @@
 module github.com/containers/tar-diff
 
-go 1.14
+go 1.18
 
 require (
 	github.com/containers/image/v5 v5.4.3
 	github.com/klauspost/compress v1.10.4
+	github.com/klauspost/pgzip v1.2.3
+)
+
+require (
+	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/sirupsen/logrus v1.4.2 // indirect
+	github.com/ulikunitz/xz v0.5.7 // indirect
+	golang.org/x/sys v0.0.0-20200327173247-9dae0f8f5775 // indirect
 )
@@ -1,11 +1,18 @@
 package common
 
 const (
-	DeltaOpData    = iota
-	DeltaOpOpen    = iota
-	DeltaOpCopy    = iota
-	DeltaOpAddData = iota
-	DeltaOpSeek    = iota
+	DeltaOpData       = iota
+	DeltaOpOpen       = iota
+	DeltaOpCopy       = iota
+	DeltaOpAddData    = iota
+	DeltaOpSeek       = iota
+	DeltaOpOpenDigest = iota // Since version 2
+	DeltaOpTransform  = iota // Since version 2
+	DeltaOpCopyOutput = iota // Since version 2
 )
 
 var DeltaHeader = [...]byte{'t', 'a', 'r', 'd', 'f', '1', '\n', 0}
+
+// Deltas that use any of the version 2 features have this header instead,
+// so that older versions of tar-patch reject them up front
+var DeltaHeaderV2 = [...]byte{'t', 'a', 'r', 'd', 'f', '2', '\n', 0}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/klauspost/pgzip"
+)
+
+const (
+	CompressionGzip  = "gzip"
+	CompressionPgzip = "pgzip"
+
+	DefaultPgzipBlockSize = 1 << 20
+)
+
+// Creates a compressor that, given the same uncompressed data, reproduces the
+// compressed stream described by info exactly
+func NewCompressor(info *CompressionInfo, w io.Writer) (io.WriteCloser, error) {
+	// Note: We always set ModTime, because pgzip doesn't special case the zero time.Time
+	modTime := time.Unix(int64(info.ModTime), 0)
+
+	switch info.Algorithm {
+	case CompressionGzip:
+		z, err := gzip.NewWriterLevel(w, info.Level)
+		if err != nil {
+			return nil, err
+		}
+		z.Name = info.Name
+		z.Comment = info.Comment
+		z.Extra = info.Extra
+		z.ModTime = modTime
+		z.OS = info.OS
+		return z, nil
+	case CompressionPgzip:
+		z, err := pgzip.NewWriterLevel(w, info.Level)
+		if err != nil {
+			return nil, err
+		}
+		if err := z.SetConcurrency(info.BlockSize, runtime.GOMAXPROCS(0)); err != nil {
+			return nil, err
+		}
+		z.Name = info.Name
+		z.Comment = info.Comment
+		z.Extra = info.Extra
+		z.ModTime = modTime
+		z.OS = info.OS
+		return z, nil
+	default:
+		return nil, fmt.Errorf("Unsupported compression algorithm '%s'", info.Algorithm)
+	}
+}
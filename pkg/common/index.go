@@ -0,0 +1,214 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Framed deltas end with an index in a skippable frame, which ends with a
+// fixed size footer so that it can be found from the end of the file.
+const (
+	DeltaIndexFrameMagic = skippableFrameMagic + 2
+
+	DeltaIndexFooterSize = 8
+)
+
+var deltaIndexFooterMagic = [...]byte{'t', 'd', 'i', 'x'}
+
+// Tags of the sections in the index frame
+const (
+	deltaIndexFrames       = 1
+	deltaIndexTOC          = 2
+	deltaIndexFrameDigests = 3
+)
+
+// TOCEntry describes an entry in the new tarfile
+type TOCEntry struct {
+	Name     string
+	Linkname string
+	Typeflag byte
+	Mode     int64
+	Size     int64
+	Offset   int64 // Offset of the entry data in the output
+}
+
+// DeltaIndex maps offsets in the output to the frames of a framed delta
+type DeltaIndex struct {
+	OutputSize uint64
+	Frames     []FrameInfo // Sorted by OutputOffset, with DeltaOffset set
+	TOC        []TOCEntry
+}
+
+func (i *DeltaIndex) Marshal() []byte {
+	w := &infoWriter{}
+
+	section := &infoWriter{}
+	section.putUvarint(i.OutputSize)
+	section.putUvarint(uint64(len(i.Frames)))
+	for _, f := range i.Frames {
+		section.putUvarint(f.DeltaOffset)
+		section.putUvarint(f.Size)
+		section.putUvarint(f.OutputOffset)
+		section.putString(f.SourceFile)
+		section.putUvarint(f.SourcePosition)
+	}
+	w.putSection(deltaIndexFrames, section)
+
+	// Source digests are in a separate section, as older versions expect a fixed set of fields per frame
+	section = &infoWriter{}
+	for j, f := range i.Frames {
+		if f.SourceDigest != "" {
+			section.putUvarint(uint64(j))
+			section.putString(f.SourceDigest)
+		}
+	}
+	if section.buf.Len() > 0 {
+		w.putSection(deltaIndexFrameDigests, section)
+	}
+
+	if len(i.TOC) > 0 {
+		section := &infoWriter{}
+		section.putUvarint(uint64(len(i.TOC)))
+		for _, e := range i.TOC {
+			section.putString(e.Name)
+			section.putString(e.Linkname)
+			section.putUvarint(uint64(e.Typeflag))
+			section.putVarint(e.Mode)
+			section.putUvarint(uint64(e.Size))
+			section.putUvarint(uint64(e.Offset))
+		}
+		w.putSection(deltaIndexTOC, section)
+	}
+
+	// The footer contains the size of the entire skippable frame
+	footer := make([]byte, DeltaIndexFooterSize)
+	binary.LittleEndian.PutUint32(footer[0:4], uint32(8+w.buf.Len()+DeltaIndexFooterSize))
+	copy(footer[4:], deltaIndexFooterMagic[:])
+	w.buf.Write(footer)
+
+	return w.buf.Bytes()
+}
+
+func unmarshalIndexFrames(r *infoReader, index *DeltaIndex) error {
+	var err error
+	if index.OutputSize, err = r.uvarint(); err != nil {
+		return err
+	}
+	count, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	for j := uint64(0); j < count; j++ {
+		f := FrameInfo{}
+		if f.DeltaOffset, err = r.uvarint(); err != nil {
+			return err
+		}
+		if f.Size, err = r.uvarint(); err != nil {
+			return err
+		}
+		if f.OutputOffset, err = r.uvarint(); err != nil {
+			return err
+		}
+		if f.SourceFile, err = r.string(); err != nil {
+			return err
+		}
+		if f.SourcePosition, err = r.uvarint(); err != nil {
+			return err
+		}
+		if len(index.Frames) > 0 && f.OutputOffset < index.Frames[len(index.Frames)-1].OutputOffset {
+			return fmt.Errorf("frames not sorted")
+		}
+		index.Frames = append(index.Frames, f)
+	}
+	return nil
+}
+
+func unmarshalIndexFrameDigests(r *infoReader, index *DeltaIndex) error {
+	for !r.atEnd() {
+		j, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		digest, err := r.string()
+		if err != nil {
+			return err
+		}
+		if j >= uint64(len(index.Frames)) {
+			return fmt.Errorf("invalid frame %d", j)
+		}
+		index.Frames[j].SourceDigest = digest
+	}
+	return nil
+}
+
+func unmarshalIndexTOC(r *infoReader, index *DeltaIndex) error {
+	count, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	for j := uint64(0); j < count; j++ {
+		var typeflag uint64
+		e := TOCEntry{}
+		if e.Name, err = r.string(); err != nil {
+			return err
+		}
+		if e.Linkname, err = r.string(); err != nil {
+			return err
+		}
+		if typeflag, err = r.uvarint(); err != nil {
+			return err
+		}
+		if e.Mode, err = r.varint(); err != nil {
+			return err
+		}
+		if e.Size, err = r.size(); err != nil {
+			return err
+		}
+		if e.Offset, err = r.size(); err != nil {
+			return err
+		}
+		e.Typeflag = byte(typeflag)
+		index.TOC = append(index.TOC, e)
+	}
+	return nil
+}
+
+// Returns the total size of the index frame given its footer, or 0 if this is not a valid footer
+func ParseDeltaIndexFooter(footer []byte) uint32 {
+	if len(footer) != DeltaIndexFooterSize || string(footer[4:]) != string(deltaIndexFooterMagic[:]) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(footer[0:4])
+}
+
+// Parses the data of the index frame (including the footer)
+func UnmarshalDeltaIndex(data []byte) (*DeltaIndex, error) {
+	if len(data) < DeltaIndexFooterSize {
+		return nil, fmt.Errorf("Invalid delta index")
+	}
+	index := &DeltaIndex{}
+	r := newInfoReader(data[:len(data)-DeltaIndexFooterSize])
+	for !r.atEnd() {
+		tag, err := r.uvarint()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid delta index: %v", err)
+		}
+		sectionData, err := r.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid delta index: %v", err)
+		}
+		section := newInfoReader(sectionData)
+		switch tag {
+		case deltaIndexFrames:
+			err = unmarshalIndexFrames(section, index)
+		case deltaIndexTOC:
+			err = unmarshalIndexTOC(section, index)
+		case deltaIndexFrameDigests:
+			err = unmarshalIndexFrameDigests(section, index)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid delta index: %v", err)
+		}
+	}
+	return index, nil
+}
@@ -0,0 +1,373 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Zstd skippable frames (magic 0x184D2A50 - 0x184D2A5F) are ignored by zstd
+// decoders, so we use them to store extra metadata in the delta that older
+// versions of tar-patch will just skip.
+const (
+	skippableFrameMask  = 0xFFFFFFF0
+	skippableFrameMagic = 0x184D2A50
+
+	DeltaInfoFrameMagic = skippableFrameMagic + 0
+	DeltaSyncFrameMagic = skippableFrameMagic + 1
+)
+
+// Tags of the sections in the delta info frame
+const (
+	deltaInfoCompression = 1
+	deltaInfoTar         = 2
+	deltaInfoSources     = 3
+	deltaInfoOutput      = 4
+)
+
+type CompressionInfo struct {
+	Algorithm string // "gzip" (compress/gzip) or "pgzip" (klauspost/pgzip)
+	Level     int
+	BlockSize int // Only used for pgzip
+
+	// gzip header fields
+	Name    string
+	Comment string
+	Extra   []byte
+	ModTime uint32
+	OS      byte
+
+	// Size and digest of the original compressed data
+	Size   int64
+	Digest string
+}
+
+// SourceInfo describes a file from the old tarfile that the delta uses
+type SourceInfo struct {
+	Path   string
+	Size   int64
+	Digest string // sha256 digest of the content, like "sha256:<hex>"
+}
+
+// DeltaInfo is optional metadata about the delta, stored in a skippable frame before the delta operations
+type DeltaInfo struct {
+	Compression *CompressionInfo
+
+	// Size and digest of the (uncompressed) new tarfile
+	TarSize   int64
+	TarDigest string
+
+	// The old files needed to apply the delta
+	Sources []SourceInfo
+
+	// How far back DeltaOpCopyOutput ops can copy from, so the size of
+	// the output history needed to apply the delta
+	OutputWindow int64
+}
+
+// FrameInfo describes the state at the start of a zstd frame in a framed delta.
+// Each frame can be decoded independently, and is preceded by a sync frame
+// containing this information.
+type FrameInfo struct {
+	OutputOffset   uint64
+	SourceFile     string
+	SourceDigest   string // Set instead of SourceFile if the source was opened by digest
+	SourcePosition uint64
+	Size           uint64 // Compressed size of the zstd frame
+	DeltaOffset    uint64 // Offset of the zstd frame in the delta, only stored in the index
+}
+
+func IsSkippableFrameMagic(magic uint32) bool {
+	return magic&skippableFrameMask == skippableFrameMagic
+}
+
+func WriteSkippableFrame(w io.Writer, magic uint32, data []byte) error {
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr[0:4], magic)
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(data)))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Reads the data of a skippable frame, the magic must already have been consumed
+func ReadSkippableFrameData(r io.Reader) ([]byte, error) {
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, sizeBuf); err != nil {
+		return nil, err
+	}
+	// Don't trust the size for allocating, the delta may be truncated or corrupt
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r, int64(binary.LittleEndian.Uint32(sizeBuf))); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+type infoWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *infoWriter) putUvarint(v uint64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, v)
+	w.buf.Write(b[:n])
+}
+
+func (w *infoWriter) putVarint(v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(b, v)
+	w.buf.Write(b[:n])
+}
+
+func (w *infoWriter) putBytes(data []byte) {
+	w.putUvarint(uint64(len(data)))
+	w.buf.Write(data)
+}
+
+func (w *infoWriter) putString(s string) {
+	w.putBytes([]byte(s))
+}
+
+func (w *infoWriter) putSection(tag uint64, section *infoWriter) {
+	w.putUvarint(tag)
+	w.putBytes(section.buf.Bytes())
+}
+
+type infoReader struct {
+	r *bytes.Reader
+}
+
+func newInfoReader(data []byte) *infoReader {
+	return &infoReader{r: bytes.NewReader(data)}
+}
+
+func (r *infoReader) atEnd() bool {
+	return r.r.Len() == 0
+}
+
+func (r *infoReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(r.r)
+}
+
+// Reads a size, which must fit in an int64
+func (r *infoReader) size() (int64, error) {
+	v, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if v > math.MaxInt64 {
+		return 0, fmt.Errorf("Value %d too large", v)
+	}
+	return int64(v), nil
+}
+
+func (r *infoReader) varint() (int64, error) {
+	return binary.ReadVarint(r.r)
+}
+
+func (r *infoReader) bytes() ([]byte, error) {
+	size, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(r.r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r.r, data)
+	return data, err
+}
+
+func (r *infoReader) string() (string, error) {
+	data, err := r.bytes()
+	return string(data), err
+}
+
+func (c *CompressionInfo) marshal(w *infoWriter) {
+	w.putString(c.Algorithm)
+	w.putVarint(int64(c.Level))
+	w.putUvarint(uint64(c.BlockSize))
+	w.putString(c.Name)
+	w.putString(c.Comment)
+	w.putBytes(c.Extra)
+	w.putUvarint(uint64(c.ModTime))
+	w.putUvarint(uint64(c.OS))
+	w.putUvarint(uint64(c.Size))
+	w.putString(c.Digest)
+}
+
+func unmarshalCompressionInfo(r *infoReader) (*CompressionInfo, error) {
+	var err error
+	var level int64
+	var blockSize, modTime, os uint64
+	c := &CompressionInfo{}
+
+	if c.Algorithm, err = r.string(); err != nil {
+		return nil, err
+	}
+	if level, err = r.varint(); err != nil {
+		return nil, err
+	}
+	if blockSize, err = r.uvarint(); err != nil {
+		return nil, err
+	}
+	if c.Name, err = r.string(); err != nil {
+		return nil, err
+	}
+	if c.Comment, err = r.string(); err != nil {
+		return nil, err
+	}
+	if c.Extra, err = r.bytes(); err != nil {
+		return nil, err
+	}
+	if modTime, err = r.uvarint(); err != nil {
+		return nil, err
+	}
+	if os, err = r.uvarint(); err != nil {
+		return nil, err
+	}
+	if c.Size, err = r.size(); err != nil {
+		return nil, err
+	}
+	if c.Digest, err = r.string(); err != nil {
+		return nil, err
+	}
+	if len(c.Extra) == 0 {
+		c.Extra = nil
+	}
+	c.Level = int(level)
+	c.BlockSize = int(blockSize)
+	c.ModTime = uint32(modTime)
+	c.OS = byte(os)
+	return c, nil
+}
+
+func (i *DeltaInfo) Marshal() []byte {
+	w := &infoWriter{}
+	if i.Compression != nil {
+		section := &infoWriter{}
+		i.Compression.marshal(section)
+		w.putSection(deltaInfoCompression, section)
+	}
+	if i.TarDigest != "" {
+		section := &infoWriter{}
+		section.putUvarint(uint64(i.TarSize))
+		section.putString(i.TarDigest)
+		w.putSection(deltaInfoTar, section)
+	}
+	if len(i.Sources) > 0 {
+		section := &infoWriter{}
+		section.putUvarint(uint64(len(i.Sources)))
+		for _, source := range i.Sources {
+			section.putString(source.Path)
+			section.putUvarint(uint64(source.Size))
+			section.putString(source.Digest)
+		}
+		w.putSection(deltaInfoSources, section)
+	}
+	if i.OutputWindow != 0 {
+		section := &infoWriter{}
+		section.putUvarint(uint64(i.OutputWindow))
+		w.putSection(deltaInfoOutput, section)
+	}
+	return w.buf.Bytes()
+}
+
+func unmarshalSources(r *infoReader) ([]SourceInfo, error) {
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	var sources []SourceInfo
+	for j := uint64(0); j < count; j++ {
+		source := SourceInfo{}
+		if source.Path, err = r.string(); err != nil {
+			return nil, err
+		}
+		if source.Size, err = r.size(); err != nil {
+			return nil, err
+		}
+		if source.Digest, err = r.string(); err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// Sections with unknown tags are ignored, so that new kinds of information can be added
+func UnmarshalDeltaInfo(data []byte) (*DeltaInfo, error) {
+	info := &DeltaInfo{}
+	r := newInfoReader(data)
+	for !r.atEnd() {
+		tag, err := r.uvarint()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid delta info: %v", err)
+		}
+		sectionData, err := r.bytes()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid delta info: %v", err)
+		}
+		section := newInfoReader(sectionData)
+		switch tag {
+		case deltaInfoCompression:
+			info.Compression, err = unmarshalCompressionInfo(section)
+		case deltaInfoTar:
+			if info.TarSize, err = section.size(); err == nil {
+				info.TarDigest, err = section.string()
+			}
+		case deltaInfoSources:
+			info.Sources, err = unmarshalSources(section)
+		case deltaInfoOutput:
+			info.OutputWindow, err = section.size()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid delta info: %v", err)
+		}
+	}
+	return info, nil
+}
+
+func (f *FrameInfo) Marshal() []byte {
+	w := &infoWriter{}
+	w.putUvarint(f.OutputOffset)
+	w.putString(f.SourceFile)
+	w.putUvarint(f.SourcePosition)
+	w.putUvarint(f.Size)
+	if f.SourceDigest != "" {
+		w.putString(f.SourceDigest)
+	}
+	return w.buf.Bytes()
+}
+
+func UnmarshalFrameInfo(data []byte) (*FrameInfo, error) {
+	var err error
+	f := &FrameInfo{}
+	r := newInfoReader(data)
+	if f.OutputOffset, err = r.uvarint(); err != nil {
+		return nil, fmt.Errorf("Invalid frame info: %v", err)
+	}
+	if f.SourceFile, err = r.string(); err != nil {
+		return nil, fmt.Errorf("Invalid frame info: %v", err)
+	}
+	if f.SourcePosition, err = r.uvarint(); err != nil {
+		return nil, fmt.Errorf("Invalid frame info: %v", err)
+	}
+	if f.Size, err = r.uvarint(); err != nil {
+		return nil, fmt.Errorf("Invalid frame info: %v", err)
+	}
+	if !r.atEnd() {
+		if f.SourceDigest, err = r.string(); err != nil {
+			return nil, fmt.Errorf("Invalid frame info: %v", err)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Transforms for DeltaOpTransform. They convert the relative branch and
+// call targets in executable code to absolute ones, so that code that
+// just moved produces the same bytes.
+const (
+	TransformNone  = 0
+	TransformX86   = 1 // E8/E9 call and jmp rel32
+	TransformARM64 = 2 // BL imm26
+)
+
+const (
+	elfMachineX86    = 3
+	elfMachineX86_64 = 62
+	elfMachineARM64  = 183
+)
+
+// The number of bytes needed by DetectTransform
+const TransformHeaderSize = 20
+
+// Returns the transform to use for a file starting with header, or
+// TransformNone if it's not a supported ELF executable
+func DetectTransform(header []byte) uint8 {
+	if len(header) < TransformHeaderSize || string(header[:4]) != "\x7fELF" {
+		return TransformNone
+	}
+	var machine uint16
+	switch header[5] {
+	case 1:
+		machine = binary.LittleEndian.Uint16(header[18:])
+	case 2:
+		machine = binary.BigEndian.Uint16(header[18:])
+	}
+	switch machine {
+	case elfMachineX86, elfMachineX86_64:
+		return TransformX86
+	case elfMachineARM64:
+		return TransformARM64
+	}
+	return TransformNone
+}
+
+func CheckTransform(transform uint8) error {
+	switch transform {
+	case TransformX86, TransformARM64:
+		return nil
+	}
+	return fmt.Errorf("Unsupported delta transform %d", transform)
+}
+
+// Applies the transform to data, which is a whole file, in place
+func EncodeTransform(transform uint8, data []byte) {
+	switch transform {
+	case TransformX86:
+		x86Transform(data, true)
+	case TransformARM64:
+		arm64Transform(data, true)
+	}
+}
+
+// Reverses EncodeTransform
+func DecodeTransform(transform uint8, data []byte) {
+	switch transform {
+	case TransformX86:
+		x86Transform(data, false)
+	case TransformARM64:
+		arm64Transform(data, false)
+	}
+}
+
+// Only rel32 values in the signed 25 bit range, i.e. with a top byte of
+// 0x00 or 0xff, are converted, and the converted value is kept in that
+// range so the decoder finds the same instructions. Opcodes within 4 bytes
+// after an unconverted one are skipped, as converting them would change
+// the top byte the decoder checks for the earlier one.
+func x86Transform(data []byte, encode bool) {
+	lastSkipped := -5
+	for i := 0; i+5 <= len(data); i++ {
+		if data[i] != 0xe8 && data[i] != 0xe9 {
+			continue
+		}
+		if i-lastSkipped <= 4 || (data[i+4] != 0x00 && data[i+4] != 0xff) {
+			lastSkipped = i
+			continue
+		}
+		v := binary.LittleEndian.Uint32(data[i+1:])
+		pos := uint32(i + 5)
+		if encode {
+			v += pos
+		} else {
+			v -= pos
+		}
+		// Sign extend from bit 24
+		v = uint32(int32(v<<7) >> 7)
+		binary.LittleEndian.PutUint32(data[i+1:], v)
+		i += 4
+	}
+}
+
+func arm64Transform(data []byte, encode bool) {
+	for i := 0; i+4 <= len(data); i += 4 {
+		instr := binary.LittleEndian.Uint32(data[i:])
+		if instr&0xfc000000 != 0x94000000 {
+			continue
+		}
+		v := instr & 0x03ffffff
+		pos := uint32(i / 4)
+		if encode {
+			v += pos
+		} else {
+			v -= pos
+		}
+		binary.LittleEndian.PutUint32(data[i:], 0x94000000|v&0x03ffffff)
+	}
+}
@@ -2,15 +2,20 @@ package tar_diff
 
 import (
 	"archive/tar"
-	"crypto/sha1"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/tar-diff/pkg/common"
 )
 
 type tarFileInfo struct {
@@ -18,39 +23,73 @@ type tarFileInfo struct {
 	basename    string
 	path        string
 	size        int64
-	sha1        string
+	offset      int64  // Offset of the content in the uncompressed tarfile
+	digest      string // sha256 digest of the content
 	blobs       []rollsumBlob
 	overwritten bool
+	transform   uint8 // The transform for executables, from common.DetectTransform()
 }
 
 type tarInfo struct {
-	files []tarFileInfo // no size=0 files
+	files  []tarFileInfo // no size=0 files
+	size   int64         // size of the uncompressed tarfile
+	digest string        // digest of the uncompressed tarfile
 }
 
 type targetInfo struct {
 	file           *tarFileInfo
 	source         *sourceInfo
 	rollsumMatches *rollsumMatches
+	duplicate      *tarFileInfo // An earlier new file with the same content
 }
 
 type sourceInfo struct {
 	file         *tarFileInfo
 	usedForDelta bool
+	usedAsIs     bool // Exact match for some target file
 	offset       int64
 }
 
 type deltaAnalysis struct {
 	targetInfos       []targetInfo
 	sourceInfos       []sourceInfo
-	sourceData        *os.File
+	sourceData        *os.File // nil if there is only a signature of the old files
 	targetInfoByIndex map[int]*targetInfo
 }
 
+// Returns the old files that the delta will need
+func (a *deltaAnalysis) requiredSources() []common.SourceInfo {
+	var sources []common.SourceInfo
+	for i := range a.sourceInfos {
+		s := &a.sourceInfos[i]
+		if s.usedForDelta || s.usedAsIs {
+			sources = append(sources, common.SourceInfo{
+				Path:   s.file.path,
+				Size:   s.file.size,
+				Digest: s.file.digest,
+			})
+		}
+	}
+	return sources
+}
+
 func (a *deltaAnalysis) Close() {
+	if a.sourceData == nil {
+		return
+	}
 	a.sourceData.Close()
 	os.Remove(a.sourceData.Name())
 }
 
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
 func isSparseFile(hdr *tar.Header) bool {
 	if hdr.Typeflag == tar.TypeGNUSparse {
 		return true
@@ -106,18 +145,26 @@ func useTarFile(hdr *tar.Header, cleanPath string) bool {
 	return true
 }
 
-func analyzeTar(tarMaybeCompressed io.Reader) (*tarInfo, error) {
+func analyzeTar(ctx context.Context, tarMaybeCompressed io.Reader, options *Options, phase ProgressPhase) (*tarInfo, error) {
 	tarFile, _, err := compression.AutoDecompress(tarMaybeCompressed)
 	if err != nil {
 		return nil, err
 	}
 	defer tarFile.Close()
 
+	tarHash := sha256.New()
+	tarCounter := &countingWriter{}
+	progress := newProgressReporter(options, phase, 0)
+	tarData := io.TeeReader(tarFile, io.MultiWriter(tarHash, tarCounter, progress))
+
 	files := make([]tarFileInfo, 0)
 	infoByPath := make(map[string]int) // map from path to index in 'files'
 
-	rdr := tar.NewReader(tarFile)
+	rdr := tar.NewReader(tarData)
 	for index := 0; true; index++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		var hdr *tar.Header
 		hdr, err = rdr.Next()
 		if err != nil {
@@ -138,30 +185,103 @@ func analyzeTar(tarMaybeCompressed io.Reader) (*tarInfo, error) {
 		if !useTarFile(hdr, pathname) {
 			continue
 		}
+		progress.setFile(pathname)
 
-		h := sha1.New()
-		r := newRollsum()
+		offset := tarCounter.n
+		h := sha256.New()
+		r := newRollsum(options)
 		w := io.MultiWriter(h, r)
 		if _, err := io.Copy(w, rdr); err != nil {
 			return nil, err
 		}
 
 		fileInfo := tarFileInfo{
-			index:    index,
-			basename: path.Base(pathname),
-			path:     pathname,
-			size:     hdr.Size,
-			sha1:     hex.EncodeToString(h.Sum(nil)),
-			blobs:    r.GetBlobs(),
+			index:     index,
+			basename:  path.Base(pathname),
+			path:      pathname,
+			size:      hdr.Size,
+			offset:    offset,
+			digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+			blobs:     r.GetBlobs(),
+			transform: common.DetectTransform(r.GetHeader()),
 		}
 		infoByPath[pathname] = len(files)
 		files = append(files, fileInfo)
 	}
 
-	info := tarInfo{files: files}
+	// Include any trailing data after the end of the archive in the digest
+	if _, err := io.Copy(ioutil.Discard, tarData); err != nil {
+		return nil, err
+	}
+
+	progress.done()
+
+	info := tarInfo{
+		files:  files,
+		size:   tarCounter.n,
+		digest: "sha256:" + hex.EncodeToString(tarHash.Sum(nil)),
+	}
 	return &info, nil
 }
 
+// Like analyzeTar, but for the regular files in a directory tree, with
+// paths relative to its root. There is no tarfile, so the size and digest
+// of the result are empty.
+func analyzeFS(ctx context.Context, fsys fs.FS, options *Options) (*tarInfo, error) {
+	files := make([]tarFileInfo, 0)
+	index := 0
+	progress := newProgressReporter(options, ProgressAnalyzeOld, 0)
+	err := fs.WalkDir(fsys, ".", func(pathname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		index++
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// The same files as useTarFile() would use
+		if fi.Size() == 0 || (fi.Mode()&00004) == 0 {
+			return nil
+		}
+
+		f, err := fsys.Open(pathname)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		progress.setFile(pathname)
+		h := sha256.New()
+		r := newRollsum(options)
+		size, err := io.Copy(io.MultiWriter(h, r, progress), f)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, tarFileInfo{
+			index:     index - 1,
+			basename:  path.Base(pathname),
+			path:      pathname,
+			size:      size,
+			digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+			blobs:     r.GetBlobs(),
+			transform: common.DetectTransform(r.GetHeader()),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	progress.done()
+	return &tarInfo{files: files}, nil
+}
+
 // This is not called for files that can be used as-is, only for files that would
 // be diffed with bsdiff or rollsums
 func isDeltaCandidate(file *tarFileInfo) bool {
@@ -200,7 +320,11 @@ func sizeIsSimilar(a *tarFileInfo, b *tarFileInfo) bool {
 	return a.size < 10*b.size && b.size < 10*a.size
 }
 
-func extractDeltaData(tarMaybeCompressed io.Reader, sourceByIndex map[int]*sourceInfo, dest *os.File) error {
+// Copies the content of the old files used for delta into dest, recording
+// where each one is stored
+type extractFunc func(ctx context.Context, sourceByIndex map[int]*sourceInfo, dest *os.File, options *Options) error
+
+func extractDeltaData(ctx context.Context, tarMaybeCompressed io.Reader, sourceByIndex map[int]*sourceInfo, dest *os.File, options *Options) error {
 	offset := int64(0)
 
 	tarFile, _, err := compression.AutoDecompress(tarMaybeCompressed)
@@ -209,8 +333,24 @@ func extractDeltaData(tarMaybeCompressed io.Reader, sourceByIndex map[int]*sourc
 	}
 	defer tarFile.Close()
 
-	rdr := tar.NewReader(tarFile)
-	for index := 0; true; index++ {
+	missing := 0
+	// Reading stops after the last file needed
+	end := int64(0)
+	for _, info := range sourceByIndex {
+		if info.usedForDelta {
+			missing++
+			if info.file.offset+info.file.size > end {
+				end = info.file.offset + info.file.size
+			}
+		}
+	}
+
+	progress := newProgressReporter(options, ProgressExtract, end)
+	rdr := tar.NewReader(io.TeeReader(tarFile, progress))
+	for index := 0; missing > 0; index++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var hdr *tar.Header
 		hdr, err = rdr.Next()
 		if err != nil {
@@ -222,13 +362,63 @@ func extractDeltaData(tarMaybeCompressed io.Reader, sourceByIndex map[int]*sourc
 		}
 		info := sourceByIndex[index]
 		if info != nil && info.usedForDelta {
+			// The analysis may come from a saved signature
+			if hdr.Size != info.file.size || cleanPath(hdr.Name) != info.file.path {
+				return fmt.Errorf("Old tarfile doesn't match its signature at %s", info.file.path)
+			}
+			progress.setFile(info.file.path)
 			info.offset = offset
 			offset += hdr.Size
 			if _, err := io.Copy(dest, rdr); err != nil {
 				return err
 			}
+			missing--
 		}
 	}
+	if missing > 0 {
+		return fmt.Errorf("Old tarfile doesn't match its signature, %d files missing", missing)
+	}
+	progress.done()
+	return nil
+}
+
+// Like extractDeltaData, but for old files from analyzeFS
+func extractDeltaDataFS(ctx context.Context, fsys fs.FS, sourceByIndex map[int]*sourceInfo, dest *os.File, options *Options) error {
+	indexes := make([]int, 0, len(sourceByIndex))
+	total := int64(0)
+	for index, info := range sourceByIndex {
+		if info.usedForDelta {
+			indexes = append(indexes, index)
+			total += info.file.size
+		}
+	}
+	sort.Ints(indexes)
+
+	progress := newProgressReporter(options, ProgressExtract, total)
+
+	offset := int64(0)
+	for _, index := range indexes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		info := sourceByIndex[index]
+		f, err := fsys.Open(info.file.path)
+		if err != nil {
+			return err
+		}
+		progress.setFile(info.file.path)
+		n, err := io.Copy(io.MultiWriter(dest, progress), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if n != info.file.size {
+			return fmt.Errorf("File %s changed while diffing", info.file.path)
+		}
+		info.offset = offset
+		offset += n
+	}
+	progress.done()
 	return nil
 }
 
@@ -238,37 +428,66 @@ func abs(n int64) int64 {
 	}
 	return n
 }
-func analyzeForDelta(old *tarInfo, new *tarInfo, oldFile io.Reader) (*deltaAnalysis, error) {
+
+// extract is nil when diffing from a signature only
+func analyzeForDelta(ctx context.Context, old *tarInfo, new *tarInfo, extract extractFunc, options *Options) (*deltaAnalysis, error) {
+	maxSources := options.maxSources
 	sourceInfos := make([]sourceInfo, 0, len(old.files))
 	for i := range old.files {
 		sourceInfos = append(sourceInfos, sourceInfo{file: &old.files[i]})
 	}
 
-	sourceBySha1 := make(map[string]*sourceInfo)
+	sourceByDigest := make(map[string]*sourceInfo)
 	sourceByPath := make(map[string]*sourceInfo)
 	sourceByIndex := make(map[int]*sourceInfo)
 	for i := range sourceInfos {
 		s := &sourceInfos[i]
 		if !s.file.overwritten {
-			sourceBySha1[s.file.sha1] = s
+			sourceByDigest[s.file.digest] = s
 			sourceByPath[s.file.path] = s
 			sourceByIndex[s.file.index] = s
 		}
 	}
 
+	// For finding the old files that share the most content with a new file
+	var blobsByCrc map[uint32][]sourceBlob
+	if maxSources > 1 {
+		candidates := make([]*sourceInfo, 0, len(sourceInfos))
+		for i := range sourceInfos {
+			s := &sourceInfos[i]
+			if !s.file.overwritten && isDeltaCandidate(s.file) {
+				candidates = append(candidates, s)
+			}
+		}
+		blobsByCrc = makeCrcMap(candidates)
+	}
+
 	targetInfos := make([]targetInfo, 0, len(new.files))
+	// The last new file with each content, for deduplication
+	targetByDigest := make(map[string]*tarFileInfo)
 
 	for i := range new.files {
 		file := &new.files[i]
 		// First look for exact content match
 		usedForDelta := false
 		var source *sourceInfo
-		sha1Source := sourceBySha1[file.sha1]
-		// If same sha1 and size, use original total size
-		if sha1Source != nil && file.size == sha1Source.file.size {
-			source = sha1Source
+		digestSource := sourceByDigest[file.digest]
+		// If same digest and size, use original total size
+		if digestSource != nil && file.size == digestSource.file.size {
+			source = digestSource
 		}
-		if source == nil && isDeltaCandidate(file) {
+
+		// Then for the same content earlier in the new tarfile
+		var duplicate *tarFileInfo
+		if source == nil && options.dedupWindow != 0 {
+			d := targetByDigest[file.digest]
+			if d != nil && d.size == file.size && file.offset-d.offset <= options.dedupWindow {
+				duplicate = d
+			}
+		}
+		targetByDigest[file.digest] = file
+
+		if source == nil && duplicate == nil && isDeltaCandidate(file) {
 			// No exact match, try to find a useful source
 
 			s := sourceByPath[file.path]
@@ -306,15 +525,36 @@ func analyzeForDelta(old *tarInfo, new *tarInfo, oldFile io.Reader) (*deltaAnaly
 			}
 		}
 
+		// Other old files with some of the same content
+		var similar []*sourceInfo
+		if blobsByCrc != nil && duplicate == nil && isDeltaCandidate(file) && (source == nil || usedForDelta) {
+			similar = findSimilarSources(blobsByCrc, file, source, maxSources)
+			if source == nil && len(similar) > 0 {
+				// No source by name, so use the most similar one by content
+				usedForDelta = true
+				source = similar[0]
+				similar = similar[1:]
+			}
+			if len(similar) > maxSources-1 {
+				similar = similar[:maxSources-1]
+			}
+		}
+
 		var rollsumMatches *rollsumMatches
 		if source != nil {
 			source.usedForDelta = source.usedForDelta || usedForDelta
+			source.usedAsIs = source.usedAsIs || !usedForDelta
 
 			if usedForDelta {
-				rollsumMatches = computeRollsumMatches(source.file.blobs, file.blobs)
+				rollsumMatches = computeRollsumMatches(append([]*sourceInfo{source}, similar...), file.blobs)
+				for _, match := range rollsumMatches.matches {
+					for _, c := range match.candidates {
+						c.source.usedForDelta = true
+					}
+				}
 			}
 		}
-		info := targetInfo{file: file, source: source, rollsumMatches: rollsumMatches}
+		info := targetInfo{file: file, source: source, rollsumMatches: rollsumMatches, duplicate: duplicate}
 		targetInfos = append(targetInfos, info)
 	}
 
@@ -324,15 +564,23 @@ func analyzeForDelta(old *tarInfo, new *tarInfo, oldFile io.Reader) (*deltaAnaly
 		targetInfoByIndex[t.file.index] = t
 	}
 
+	analysis := &deltaAnalysis{targetInfos: targetInfos, targetInfoByIndex: targetInfoByIndex, sourceInfos: sourceInfos}
+	if extract == nil {
+		return analysis, nil
+	}
+
 	tmpfile, err := ioutil.TempFile("/var/tmp", "tar-diff-")
 	if err != nil {
 		return nil, err
 	}
 
-	err = extractDeltaData(oldFile, sourceByIndex, tmpfile)
+	err = extract(ctx, sourceByIndex, tmpfile, options)
 	if err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
 		return nil, err
 	}
 
-	return &deltaAnalysis{targetInfos: targetInfos, targetInfoByIndex: targetInfoByIndex, sourceInfos: sourceInfos, sourceData: tmpfile}, nil
+	analysis.sourceData = tmpfile
+	return analysis, nil
 }
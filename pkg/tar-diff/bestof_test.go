@@ -0,0 +1,81 @@
+package tar_diff
+
+import (
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestBestOf(t *testing.T) {
+	data := tartest.RandomData(1, 64*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("same", data[:1000]),
+		tartest.File("modified", data),
+		tartest.File("replaced.gz", tartest.RandomData(2, 64*1024)),
+	}, []tartest.Entry{
+		tartest.File("same", data[:1000]),
+		tartest.File("modified", tartest.Modify(data, 1000)),
+		// Random data, where bsdiff only adds overhead
+		tartest.File("replaced.gz", tartest.RandomData(3, 64*1024)),
+		tartest.File("new", []byte("new file")),
+	})
+
+	makeDelta := func(bestOf bool) ([]byte, map[string]FileEncoding) {
+		encodings := make(map[string]FileEncoding)
+		options := NewOptions()
+		options.SetBestOf(bestOf)
+		options.SetFileReport(func(report *FileReport) {
+			encodings[report.Path] = report.Encoding
+		})
+		return diffAndApply(t, layers, options), encodings
+	}
+
+	defaultDelta, defaultEncodings := makeDelta(false)
+	bestDelta, bestEncodings := makeDelta(true)
+	if len(bestDelta) > len(defaultDelta) {
+		t.Errorf("Best-of delta is larger than the default, %d > %d", len(bestDelta), len(defaultDelta))
+	}
+
+	expected := map[string]FileEncoding{
+		"same":        EncodingOldFile,
+		"modified":    EncodingBsdiff,
+		"replaced.gz": EncodingLiteral,
+		"new":         EncodingLiteral,
+	}
+	for path, encoding := range expected {
+		if bestEncodings[path] != encoding {
+			t.Errorf("%s: expected %s, got %s", path, encoding, bestEncodings[path])
+		}
+	}
+	if defaultEncodings["replaced.gz"] != EncodingBsdiff {
+		t.Errorf("Expected bsdiff for replaced.gz by default, got %s", defaultEncodings["replaced.gz"])
+	}
+}
+
+func TestBestOfLargeFiles(t *testing.T) {
+	data := tartest.RandomData(1, 256*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("small", data[:16*1024]),
+		tartest.File("large", data),
+	}, []tartest.Entry{
+		tartest.File("small", tartest.Modify(data[:16*1024], 1000)),
+		tartest.File("large", tartest.Modify(data, 50000)),
+	})
+
+	reports := make(map[string]FileReport)
+	options := NewOptions()
+	options.SetBestOf(true)
+	options.SetMaxBsdiffFileSize(64 * 1024)
+	options.SetFileReport(func(report *FileReport) {
+		reports[report.Path] = *report
+	})
+	diffAndApply(t, layers, options)
+
+	// Only best-of records the encoded size
+	if reports["small"].EncodedSize == 0 {
+		t.Errorf("Expected best-of encoding for the small file")
+	}
+	if reports["large"].EncodedSize != 0 || reports["large"].Encoding != EncodingRollsum {
+		t.Errorf("Expected the default rollsum encoding for the large file, got %s", reports["large"].Encoding)
+	}
+}
@@ -34,11 +34,17 @@ package tar_diff
 
 import (
 	"bytes"
+	"context"
 )
 
-func bsdiff(oldbin, newbin []byte, deltaWriter *deltaWriter) error {
+// How often the long loops check if the context is cancelled, in bytes
+const cancelCheckInterval = 1024 * 1024
+
+func bsdiff(ctx context.Context, oldbin, newbin []byte, deltaWriter *deltaWriter) error {
 	iii := make([]int, len(oldbin)+1)
-	qsufsort(iii, oldbin)
+	if err := qsufsort(ctx, iii, oldbin); err != nil {
+		return err
+	}
 
 	//var db
 	var dblen, eblen, ebpos, slen int
@@ -54,6 +60,7 @@ func bsdiff(oldbin, newbin []byte, deltaWriter *deltaWriter) error {
 	var overlap, Ss, lens int
 
 	db := make([]byte, 4096)
+	nextCheck := cancelCheckInterval
 
 	for scan < newsize {
 		oldscore = 0
@@ -62,6 +69,12 @@ func bsdiff(oldbin, newbin []byte, deltaWriter *deltaWriter) error {
 		scan += ln
 		scsc = scan
 		for scan < newsize {
+			if scan >= nextCheck {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				nextCheck = scan + cancelCheckInterval
+			}
 			ln = search(iii, oldbin, newbin[scan:], 0, oldsize, &pos)
 
 			for scsc < scan+ln {
@@ -214,7 +227,7 @@ func matchlen(oldbin []byte, newbin []byte) int {
 	return i
 }
 
-func qsufsort(iii []int, buf []byte) {
+func qsufsort(ctx context.Context, iii []int, buf []byte) error {
 	buckets := make([]int, 256)
 	vvv := make([]int, len(iii))
 	var i, h, ln int
@@ -255,7 +268,14 @@ func qsufsort(iii []int, buf []byte) {
 		ln = 0
 
 		i = 0
+		nextCheck := 0
 		for i < bufzise+1 {
+			if i >= nextCheck {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				nextCheck = i + cancelCheckInterval
+			}
 			if iii[i] < 0 {
 				ln -= iii[i]
 				i -= iii[i]
@@ -277,6 +297,7 @@ func qsufsort(iii []int, buf []byte) {
 	for i = 0; i < bufzise+1; i++ {
 		iii[vvv[i]] = i
 	}
+	return nil
 }
 
 func split(iii, vvv []int, start, ln, h int) {
@@ -0,0 +1,87 @@
+package tar_diff
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tar-patch"
+)
+
+// DataSource with a single file, for applying bsdiff output
+type singleFileDataSource struct {
+	*bytes.Reader
+}
+
+func (s *singleFileDataSource) SetCurrentFile(file string) error {
+	_, err := s.Seek(0, 0)
+	return err
+}
+
+func (s *singleFileDataSource) Close() error {
+	return nil
+}
+
+func FuzzQsufsort(f *testing.F) {
+	f.Add([]byte("banana"))
+	f.Add([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	f.Add([]byte{0, 255, 0, 255, 1, 1, 1, 0})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		if len(buf) > 64*1024 {
+			return
+		}
+		iii := make([]int, len(buf)+1)
+		if err := qsufsort(context.Background(), iii, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make([]bool, len(iii))
+		for i, pos := range iii {
+			if pos < 0 || pos > len(buf) || seen[pos] {
+				t.Fatalf("Invalid suffix array entry %d at %d", pos, i)
+			}
+			seen[pos] = true
+			if i > 0 && bytes.Compare(buf[iii[i-1]:], buf[pos:]) >= 0 {
+				t.Fatalf("Suffixes %d and %d not sorted", iii[i-1], pos)
+			}
+		}
+	})
+}
+
+func FuzzBsdiff(f *testing.F) {
+	f.Add([]byte("hello world, hello world"), []byte("hello there world, hello world!"))
+	f.Add([]byte{}, []byte("new"))
+	f.Add([]byte("old"), []byte{})
+	f.Add(bytes.Repeat([]byte{1, 2, 3, 4}, 100), bytes.Repeat([]byte{1, 2, 4, 4}, 110))
+
+	f.Fuzz(func(t *testing.T, oldData []byte, newData []byte) {
+		if len(oldData) > 64*1024 || len(newData) > 64*1024 {
+			return
+		}
+
+		var delta bytes.Buffer
+		d, err := newDeltaWriter(&delta, nil, NewOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.SetCurrentFile(&tarFileInfo{path: "old"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := bsdiff(context.Background(), oldData, newData, d); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		dataSource := &singleFileDataSource{bytes.NewReader(oldData)}
+		if err := tar_patch.Apply(bytes.NewReader(delta.Bytes()), dataSource, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), newData) {
+			t.Fatal("Output doesn't match the new data")
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package tar_diff
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"github.com/containers/tar-diff/pkg/common"
+)
+
+var errCompressionMismatch = errors.New("Compressed data mismatch")
+
+// Compressors we try to match against, in order of likelyhood. containers/image
+// uses pgzip with the default level (which is 5 for klauspost/compress)
+var compressionCandidates = []struct {
+	algorithm string
+	level     int
+}{
+	{common.CompressionPgzip, 5},
+	{common.CompressionGzip, 6},
+	{common.CompressionPgzip, 1}, {common.CompressionPgzip, 2}, {common.CompressionPgzip, 3},
+	{common.CompressionPgzip, 4}, {common.CompressionPgzip, 6}, {common.CompressionPgzip, 7},
+	{common.CompressionPgzip, 8}, {common.CompressionPgzip, 9},
+	{common.CompressionGzip, 1}, {common.CompressionGzip, 2}, {common.CompressionGzip, 3},
+	{common.CompressionGzip, 4}, {common.CompressionGzip, 5}, {common.CompressionGzip, 7},
+	{common.CompressionGzip, 8}, {common.CompressionGzip, 9},
+}
+
+// This is a writer that fails as soon as what is written differs from the expected data
+type compareWriter struct {
+	expected io.Reader
+	buf      []byte
+}
+
+func (c *compareWriter) Write(p []byte) (int, error) {
+	if len(c.buf) < len(p) {
+		c.buf = make([]byte, len(p))
+	}
+	buf := c.buf[:len(p)]
+	if _, err := io.ReadFull(c.expected, buf); err != nil {
+		return 0, errCompressionMismatch
+	}
+	if !bytes.Equal(buf, p) {
+		return 0, errCompressionMismatch
+	}
+	return len(p), nil
+}
+
+// Recompress the uncompressed data and check that it is identical to the original
+func compressionMatches(file io.ReaderAt, size int64, info *common.CompressionInfo) (bool, error) {
+	decompressor, err := gzip.NewReader(io.NewSectionReader(file, 0, size))
+	if err != nil {
+		return false, err
+	}
+	defer decompressor.Close()
+
+	compare := &compareWriter{expected: bufio.NewReader(io.NewSectionReader(file, 0, size))}
+	compressor, err := common.NewCompressor(info, compare)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = io.Copy(compressor, decompressor)
+	closeErr := compressor.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == errCompressionMismatch {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Make sure there is no trailing data we didn't produce
+	var extra [1]byte
+	if n, _ := compare.expected.Read(extra[:]); n != 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+// Try to figure out the exact compressor parameters used to create the
+// compressed file, so that tar-patch can reproduce it. Returns nil if
+// the file is not compressed with a known compressor. This needs to
+// re-read the file, so it only works if it implements io.ReaderAt.
+func detectCompression(file io.ReadSeeker) (*common.CompressionInfo, error) {
+	fileAt, ok := file.(io.ReaderAt)
+	if !ok {
+		return nil, nil
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressor, err := gzip.NewReader(io.NewSectionReader(fileAt, 0, size))
+	if err != nil {
+		// Not gzip compressed
+		return nil, nil
+	}
+	header := decompressor.Header
+	decompressor.Close()
+
+	modTime := uint32(0)
+	if !header.ModTime.IsZero() {
+		modTime = uint32(header.ModTime.Unix())
+	}
+
+	for _, candidate := range compressionCandidates {
+		info := &common.CompressionInfo{
+			Algorithm: candidate.algorithm,
+			Level:     candidate.level,
+			Name:      header.Name,
+			Comment:   header.Comment,
+			Extra:     header.Extra,
+			ModTime:   modTime,
+			OS:        header.OS,
+			Size:      size,
+			Digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		}
+		if candidate.algorithm == common.CompressionPgzip {
+			info.BlockSize = common.DefaultPgzipBlockSize
+		}
+
+		matches, err := compressionMatches(fileAt, size, info)
+		if err != nil {
+			return nil, err
+		}
+		if matches {
+			return info, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,100 @@
+package tar_diff
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestDiffContext(t *testing.T) {
+	big := tartest.RandomData(1, 4*1024*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("small", []byte("old\n")),
+		tartest.File("big", big),
+	}, []tartest.Entry{
+		tartest.File("small", []byte("new\n")),
+		tartest.File("big", tartest.Modify(big, 1000)),
+	})
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := DiffContext(cancelled, bytes.NewReader(layers.Old), bytes.NewReader(layers.New), &bytes.Buffer{}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled diff, got %v", err)
+	}
+
+	// The big file is diffed with bsdiff last, so only bsdiff itself
+	// can notice the cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := NewOptions()
+	options.SetProgress(func(e ProgressEvent) {
+		if e.Phase == ProgressGenerate && e.File == "big" {
+			cancel()
+		}
+	})
+	err = DiffContext(ctx, bytes.NewReader(layers.Old), bytes.NewReader(layers.New), &bytes.Buffer{}, options)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected diff cancelled in bsdiff, got %v", err)
+	}
+}
+
+func TestDiffContextVariants(t *testing.T) {
+	data := tartest.RandomData(1, 64*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("file", data),
+	}, []tartest.Entry{
+		tartest.File("file", tartest.Modify(data, 1000)),
+	})
+	oldFS := fstest.MapFS{
+		"file": &fstest.MapFile{Data: data},
+	}
+	signature, err := AnalyzeTar(bytes.NewReader(layers.Old), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, diff := range map[string]func(ctx context.Context, options *Options) error{
+		"AnalyzeTar": func(ctx context.Context, options *Options) error {
+			_, err := AnalyzeTarContext(ctx, bytes.NewReader(layers.Old), options)
+			return err
+		},
+		"AnalyzeFS": func(ctx context.Context, options *Options) error {
+			_, err := AnalyzeFSContext(ctx, oldFS, options)
+			return err
+		},
+		"DiffWithSignature": func(ctx context.Context, options *Options) error {
+			return DiffWithSignatureContext(ctx, signature, bytes.NewReader(layers.Old), bytes.NewReader(layers.New), &bytes.Buffer{}, options)
+		},
+		"DiffFS": func(ctx context.Context, options *Options) error {
+			return DiffFSContext(ctx, oldFS, bytes.NewReader(layers.New), &bytes.Buffer{}, options)
+		},
+	} {
+		if err := diff(context.Background(), nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := diff(cancelled, nil); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected cancelled, got %v", name, err)
+		}
+	}
+
+	// Cancelling after the old files are analyzed stops the diff itself
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := NewOptions()
+	options.SetProgress(func(e ProgressEvent) {
+		if e.Phase == ProgressAnalyzeNew {
+			cancel()
+		}
+	})
+	err = DiffFSContext(ctx, oldFS, bytes.NewReader(layers.New), &bytes.Buffer{}, options)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected DiffFS cancelled while analyzing the new tarfile, got %v", err)
+	}
+}
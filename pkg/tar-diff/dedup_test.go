@@ -0,0 +1,39 @@
+package tar_diff
+
+import (
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestDedup(t *testing.T) {
+	lib := tartest.RandomData(1, 256*1024)
+	// zstd finds repeats within its window of 8MB by itself, so the copies
+	// are further apart than that
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("README", []byte("old\n")),
+	}, []tartest.Entry{
+		tartest.File("app1/lib.so", lib),
+		tartest.File("app1/data", make([]byte, 9*1024*1024)),
+		tartest.File("app2/lib.so", lib),
+		tartest.File("app3/lib.so", lib),
+	})
+
+	diff := func(window int64, frameSize int64) []byte {
+		options := NewOptions()
+		options.SetDedupWindow(window)
+		options.SetFrameSize(frameSize)
+		return diffAndApply(t, layers, options)
+	}
+
+	if delta := diff(0, 0); len(delta) < 2*len(lib) {
+		t.Errorf("Expected two copies as literal data without dedup, delta is %d", len(delta))
+	}
+	if delta := diff(1024*1024, 0); len(delta) < 2*len(lib) {
+		t.Errorf("Expected no dedup with a small window, delta is %d", len(delta))
+	}
+	if delta := diff(16*1024*1024, 0); len(delta) > len(lib)+64*1024 {
+		t.Errorf("Delta with dedup is too large, %d", len(delta))
+	}
+	diff(16*1024*1024, 512*1024)
+}
@@ -1,6 +1,7 @@
 package tar_diff
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/containers/tar-diff/pkg/common"
 	"github.com/klauspost/compress/zstd"
@@ -12,27 +13,210 @@ const (
 )
 
 type deltaWriter struct {
-	writer      *zstd.Encoder
-	buffer      []byte
-	currentFile string
-	currentPos  uint64
+	writer         *zstd.Encoder
+	buffer         []byte
+	currentFile    string // Path or digest, depending on sourceByDigest
+	currentPos     uint64
+	sourceByDigest bool
+
+	// Framing: if frameSize is set, a new zstd frame is started at the first
+	// op after frameSize bytes of output, and each frame is preceded by a sync
+	// frame so it can be decoded independently of the previous frames. All
+	// the frames are listed in an index at the end.
+	output      io.Writer
+	outputPos   uint64
+	deltaOffset uint64
+	frameSize   uint64
+	frameBuf    bytes.Buffer
+	frame       common.FrameInfo
+	frameOps    int
+	frames      []common.FrameInfo
+	toc         []common.TOCEntry
+
+	// New frames can't start inside a transform, which ends here
+	transformEnd uint64
+
+	// For scratch writers, the uncompressed ops and the compressed size
+	recorded       *bytes.Buffer
+	compressedSize *countingWriter
 }
 
-func newDeltaWriter(writer io.Writer, compressionLevel int) (*deltaWriter, error) {
-	_, err := writer.Write(common.DeltaHeader[:])
+func newDeltaWriter(writer io.Writer, info *common.DeltaInfo, options *Options) (*deltaWriter, error) {
+	header := common.DeltaHeader
+	if options.sourceByDigest || options.transformExecutables || options.dedupWindow != 0 {
+		header = common.DeltaHeaderV2
+	}
+	_, err := writer.Write(header[:])
 	if err != nil {
 		return nil, err
 	}
 
-	encoder, err := zstd.NewWriter(writer, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compressionLevel)))
+	deltaOffset := uint64(len(header))
+
+	if info != nil {
+		if infoData := info.Marshal(); len(infoData) > 0 {
+			if err := common.WriteSkippableFrame(writer, common.DeltaInfoFrameMagic, infoData); err != nil {
+				return nil, err
+			}
+			deltaOffset += 8 + uint64(len(infoData))
+		}
+	}
+
+	d := deltaWriter{
+		buffer:         make([]byte, 0, deltaDataChunkSize),
+		sourceByDigest: options.sourceByDigest,
+		output:         writer,
+		deltaOffset:    deltaOffset,
+		frameSize:      uint64(options.frameSize),
+	}
+
+	encoderOutput := writer
+	if d.frameSize != 0 {
+		encoderOutput = &d.frameBuf
+	}
+	encoder, err := zstd.NewWriter(encoderOutput, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.compressionLevel)))
 	if err != nil {
 		return nil, err
 	}
-	d := deltaWriter{writer: encoder, buffer: make([]byte, 0, deltaDataChunkSize)}
+	d.writer = encoder
 	return &d, nil
 }
 
+// Write out the current frame (if any), preceded by its sync frame
+func (d *deltaWriter) endFrame() error {
+	if err := d.writer.Close(); err != nil {
+		return err
+	}
+	if d.frameOps > 0 {
+		d.frame.Size = uint64(d.frameBuf.Len())
+		syncData := d.frame.Marshal()
+		if err := common.WriteSkippableFrame(d.output, common.DeltaSyncFrameMagic, syncData); err != nil {
+			return err
+		}
+		d.frame.DeltaOffset = d.deltaOffset + 8 + uint64(len(syncData))
+		if _, err := d.output.Write(d.frameBuf.Bytes()); err != nil {
+			return err
+		}
+		d.deltaOffset = d.frame.DeltaOffset + d.frame.Size
+		d.frames = append(d.frames, d.frame)
+	}
+	d.frameBuf.Reset()
+	return nil
+}
+
+func (d *deltaWriter) startFrame() {
+	d.writer.Reset(&d.frameBuf)
+	d.frame = common.FrameInfo{
+		OutputOffset:   d.outputPos,
+		SourcePosition: d.currentPos,
+	}
+	if d.sourceByDigest {
+		d.frame.SourceDigest = d.currentFile
+	} else {
+		d.frame.SourceFile = d.currentFile
+	}
+	d.frameOps = 0
+}
+
+// Returns a writer for trying out an encoding, starting in the same source
+// state as d. Its ops can then be written to d with writeRecorded(), if
+// the compressed size is good.
+func (d *deltaWriter) newScratchWriter(options *Options) (*deltaWriter, error) {
+	s := &deltaWriter{
+		buffer:         make([]byte, 0, deltaDataChunkSize),
+		currentFile:    d.currentFile,
+		currentPos:     d.currentPos,
+		sourceByDigest: d.sourceByDigest,
+		recorded:       &bytes.Buffer{},
+		compressedSize: &countingWriter{},
+	}
+	encoder, err := zstd.NewWriter(s.compressedSize, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.compressionLevel)), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	s.writer = encoder
+	return s, nil
+}
+
+// Finishes a scratch writer, returning the compressed size of its ops
+func (d *deltaWriter) finishScratch() (int64, error) {
+	if err := d.FlushBuffer(); err != nil {
+		return 0, err
+	}
+	if err := d.Close(); err != nil {
+		return 0, err
+	}
+	return d.compressedSize.n, nil
+}
+
+// Writes the ops recorded by a finished scratch writer
+func (d *deltaWriter) writeRecorded(s *deltaWriter) error {
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
+	r := bytes.NewReader(s.recorded.Bytes())
+	for r.Len() > 0 {
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		switch op {
+		case common.DeltaOpData, common.DeltaOpOpen, common.DeltaOpOpenDigest, common.DeltaOpAddData:
+			data = make([]byte, size)
+		case common.DeltaOpTransform:
+			data = make([]byte, 1)
+		}
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if op == common.DeltaOpCopyOutput {
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			data = appendUvarint(nil, offset)
+		}
+		if err := d.writeOp(op, size, data); err != nil {
+			return err
+		}
+
+		switch op {
+		case common.DeltaOpOpen, common.DeltaOpOpenDigest:
+			d.currentFile = string(data)
+			d.currentPos = 0
+		case common.DeltaOpSeek:
+			d.currentPos = size
+		case common.DeltaOpCopy, common.DeltaOpAddData:
+			d.currentPos += size
+		}
+	}
+	return nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(b, v)
+	return append(buf, b[:n]...)
+}
+
+// Whether the next op starts a new frame
+func (d *deltaWriter) startsFrame() bool {
+	return d.frameSize != 0 && d.outputPos >= d.transformEnd && d.outputPos-d.frame.OutputOffset >= d.frameSize
+}
+
 func (d *deltaWriter) writeOp(op uint8, size uint64, data []byte) error {
+	if d.startsFrame() {
+		if err := d.endFrame(); err != nil {
+			return err
+		}
+		d.startFrame()
+	}
+
 	buf := make([]byte, 1+binary.MaxVarintLen64)
 	buf[0] = op
 	sizeLen := binary.PutUvarint(buf[1:], size)
@@ -47,10 +231,29 @@ func (d *deltaWriter) writeOp(op uint8, size uint64, data []byte) error {
 			return err
 		}
 	}
+	if d.recorded != nil {
+		d.recorded.Write(buf[:bufLen])
+		d.recorded.Write(data)
+	}
+
+	switch op {
+	case common.DeltaOpData, common.DeltaOpCopy, common.DeltaOpAddData, common.DeltaOpCopyOutput:
+		d.outputPos += size
+	case common.DeltaOpTransform:
+		d.transformEnd = d.outputPos + size
+	}
+	d.frameOps++
 
 	return nil
 }
 
+// Records an entry for the table of contents in the index of framed deltas
+func (d *deltaWriter) AddTOCEntry(entry common.TOCEntry) {
+	if d.frameSize != 0 {
+		d.toc = append(d.toc, entry)
+	}
+}
+
 func (d *deltaWriter) FlushBuffer() error {
 	if len(d.buffer) == 0 {
 		return nil
@@ -64,7 +267,16 @@ func (d *deltaWriter) Close() error {
 	if d.writer == nil {
 		return nil
 	}
-	err := d.writer.Close()
+	var err error
+	if d.frameSize != 0 {
+		err = d.endFrame()
+		if err == nil {
+			index := common.DeltaIndex{OutputSize: d.outputPos, Frames: d.frames, TOC: d.toc}
+			err = common.WriteSkippableFrame(d.output, common.DeltaIndexFrameMagic, index.Marshal())
+		}
+	} else {
+		err = d.writer.Close()
+	}
 	d.writer = nil
 	return err
 }
@@ -80,19 +292,23 @@ func (d *deltaWriter) WriteContent(data []byte) error {
 }
 
 // Switches to new file if needed and ensures we're at the start of it
-func (d *deltaWriter) SetCurrentFile(filename string) error {
-	if d.currentFile != filename {
-		nameBytes := []byte(filename)
+func (d *deltaWriter) SetCurrentFile(file *tarFileInfo) error {
+	op, name := uint8(common.DeltaOpOpen), file.path
+	if d.sourceByDigest {
+		op, name = common.DeltaOpOpenDigest, file.digest
+	}
+	if d.currentFile != name {
+		nameBytes := []byte(name)
 		err := d.FlushBuffer()
 		if err != nil {
 			return err
 		}
-		err = d.writeOp(common.DeltaOpOpen, uint64(len(nameBytes)), nameBytes)
+		err = d.writeOp(op, uint64(len(nameBytes)), nameBytes)
 		if err != nil {
 			return err
 		}
 
-		d.currentFile = filename
+		d.currentFile = name
 		d.currentPos = 0
 	}
 	return nil
@@ -117,17 +333,17 @@ func (d *deltaWriter) Seek(pos uint64) error {
 }
 
 func (d *deltaWriter) SeekForward(pos uint64) error {
-	d.currentPos += pos
-
 	err := d.FlushBuffer()
 	if err != nil {
 		return err
 	}
 
-	err = d.writeOp(common.DeltaOpSeek, d.currentPos, nil)
+	newPos := d.currentPos + pos
+	err = d.writeOp(common.DeltaOpSeek, newPos, nil)
 	if err != nil {
 		return err
 	}
+	d.currentPos = newPos
 	return nil
 }
 
@@ -160,6 +376,40 @@ func (d *deltaWriter) WriteAddContent(data []byte) error {
 	return nil
 }
 
+// The following ops, up to size bytes of output, produce transformed output
+// from the transformed current file. EndTransform() must be called after them.
+func (d *deltaWriter) StartTransform(transform uint8, size uint64) error {
+	if err := d.FlushBuffer(); err != nil {
+		return err
+	}
+	return d.writeOp(common.DeltaOpTransform, size, []byte{transform})
+}
+
+// Makes sure no data after the transform is merged into its ops
+func (d *deltaWriter) EndTransform() error {
+	return d.FlushBuffer()
+}
+
+// Copies size bytes of earlier output at offset, if possible. This is not
+// possible if the offset is before the start of the current frame, as
+// each frame must be decodable on its own.
+func (d *deltaWriter) CopyOutput(offset uint64, size uint64) (bool, error) {
+	if err := d.FlushBuffer(); err != nil {
+		return false, err
+	}
+	frameStart := d.frame.OutputOffset
+	if d.startsFrame() {
+		frameStart = d.outputPos
+	}
+	if offset < frameStart {
+		return false, nil
+	}
+	if err := d.writeOp(common.DeltaOpCopyOutput, size, appendUvarint(nil, offset)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func (d *deltaWriter) CopyFileAt(offset uint64, size uint64) error {
 	if err := d.Seek(offset); err != nil {
 		return err
@@ -170,15 +420,15 @@ func (d *deltaWriter) CopyFileAt(offset uint64, size uint64) error {
 	return nil
 }
 
-func (d *deltaWriter) WriteOldFile(filename string, size uint64) error {
-	err := d.SetCurrentFile(filename)
+func (d *deltaWriter) WriteOldFile(file *tarFileInfo) error {
+	err := d.SetCurrentFile(file)
 	if err != nil {
 		return err
 	}
 	if err := d.Seek(0); err != nil {
 		return err
 	}
-	err = d.CopyFile(size)
+	err = d.CopyFile(uint64(file.size))
 	if err != nil {
 		return err
 	}
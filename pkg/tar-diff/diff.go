@@ -7,10 +7,15 @@ package tar_diff
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"os"
 
 	"github.com/containers/image/v5/pkg/compression"
+	"github.com/containers/tar-diff/pkg/common"
 )
 
 const (
@@ -18,6 +23,7 @@ const (
 )
 
 type deltaGenerator struct {
+	ctx             context.Context
 	stealingTarFile *stealerReader
 	tarReader       *tar.Reader
 	analysis        *deltaAnalysis
@@ -70,141 +76,434 @@ func (g *deltaGenerator) readSourceData(source *sourceInfo, offset int64, size i
 	return buf, err
 }
 
-func (g *deltaGenerator) generateForFileWithBsdiff(info *targetInfo) error {
-	file := info.file
-	source := info.source
+// Source of the new file content for the encoders, either streamed from
+// the new tarfile or from memory
+type fileContent interface {
+	// Read the next n bytes, not copying them to the delta
+	readN(n int64) ([]byte, error)
+	// Copy the next n bytes into the delta
+	copyN(n int64) error
+}
 
-	err := g.deltaWriter.SetCurrentFile(source.file.path)
-	if err != nil {
+type memoryContent struct {
+	data        []byte
+	deltaWriter *deltaWriter
+}
+
+func (m *memoryContent) readN(n int64) ([]byte, error) {
+	buf := m.data[:n]
+	m.data = m.data[n:]
+	return buf, nil
+}
+
+func (m *memoryContent) copyN(n int64) error {
+	buf, _ := m.readN(n)
+	return m.deltaWriter.WriteContent(buf)
+}
+
+// Writes a bsdiff delta from the old file, transforming the ops if transform is set
+func encodeBsdiff(ctx context.Context, deltaWriter *deltaWriter, source *tarFileInfo, oldData []byte, newData []byte, transform uint8) error {
+	if err := deltaWriter.SetCurrentFile(source); err != nil {
 		return err
 	}
+	if err := deltaWriter.Seek(0); err != nil {
+		return err
+	}
+	if transform == common.TransformNone {
+		return bsdiff(ctx, oldData, newData, deltaWriter)
+	}
 
-	err = g.deltaWriter.Seek(0)
-	if err != nil {
+	if err := deltaWriter.StartTransform(transform, uint64(len(newData))); err != nil {
+		return err
+	}
+	// bsdiff doesn't keep references to its input, so transform in place
+	common.EncodeTransform(transform, oldData)
+	common.EncodeTransform(transform, newData)
+	if err := bsdiff(ctx, oldData, newData, deltaWriter); err != nil {
 		return err
 	}
+	return deltaWriter.EndTransform()
+}
 
-	oldData, err := g.readSourceData(source, 0, source.file.size)
+// Reads the whole old and new file
+func (g *deltaGenerator) readFileData(info *targetInfo) ([]byte, []byte, error) {
+	oldData, err := g.readSourceData(info.source, 0, info.source.file.size)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	newData, err := g.readN(info.file.size)
+	if err != nil {
+		return nil, nil, err
 	}
+	return oldData, newData, nil
+}
 
-	newData, err := g.readN(file.size)
+func (g *deltaGenerator) generateForFileWithBsdiff(info *targetInfo) error {
+	oldData, newData, err := g.readFileData(info)
 	if err != nil {
 		return err
 	}
+	return encodeBsdiff(g.ctx, g.deltaWriter, info.source.file, oldData, newData, common.TransformNone)
+}
+
+// Returns the first candidate of a match whose data, from skip bytes into
+// the blob, is equal to data, or nil if there is none
+func (g *deltaGenerator) verifyMatch(match *rollsumMatch, skip int64, data []byte) (*sourceInfo, int64, error) {
+	if g.analysis.sourceData == nil {
+		// Without the old data, rely on the strong hashes of the blobs
+		c := match.candidates[0]
+		return c.source, c.blob.offset + skip, nil
+	}
+	for _, c := range match.candidates {
+		srcbuf, err := g.readSourceData(c.source, c.blob.offset+skip, int64(len(data)))
+		if err != nil {
+			return nil, 0, err
+		}
+		if bytes.Equal(data, srcbuf) {
+			return c.source, c.blob.offset + skip, nil
+		}
+	}
+	return nil, 0, nil
+}
 
-	err = bsdiff(oldData, newData, g.deltaWriter)
+// Returns how many bytes at the end of data are equal to the old data before offset
+func (g *deltaGenerator) matchBackward(source *sourceInfo, offset int64, data []byte) (int64, error) {
+	n := int64(len(data))
+	if n > offset {
+		n = offset
+	}
+	if n == 0 || g.analysis.sourceData == nil {
+		return 0, nil
+	}
+	srcbuf, err := g.readSourceData(source, offset-n, n)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	k := int64(0)
+	for k < n && data[int64(len(data))-1-k] == srcbuf[n-1-k] {
+		k++
+	}
+	return k, nil
+}
 
-	return nil
+func commonPrefix(a []byte, b []byte) int64 {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return int64(n)
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
 }
 
-func (g *deltaGenerator) generateForFileWithrollsums(info *targetInfo) error {
+func (g *deltaGenerator) generateForFileWithrollsums(info *targetInfo, content fileContent, deltaWriter *deltaWriter) error {
 	file := info.file
-	source := info.source
 	matches := info.rollsumMatches.matches
 	pos := int64(0)
-
-	err := g.deltaWriter.SetCurrentFile(source.file.path)
-	if err != nil {
-		return err
-	}
+	// Data read from the new file, but not written yet, ending at pos
+	var pending []byte
 
 	for i := range matches {
 		match := &matches[i]
 		matchStart := match.to.offset
 		matchSize := match.to.size
 
-		// Copy upto next match
-		if pos < matchStart {
-			if err := g.copyN(matchStart - pos); err != nil {
+		// The previous match may have been extended into this one
+		skip := int64(0)
+		if matchStart < pos {
+			skip = pos - matchStart
+			if skip >= matchSize {
+				continue
+			}
+		}
+
+		// Copy upto next match, keeping the end for extending it backwards
+		if gap := matchStart - pos; gap > 0 {
+			// Extend at most one blob back
+			keep := min64(gap, g.options.maxChunkSize)
+			if gap > keep {
+				if err := deltaWriter.WriteContent(pending); err != nil {
+					return err
+				}
+				pending = nil
+				if err := content.copyN(gap - keep); err != nil {
+					return err
+				}
+			}
+			buf, err := content.readN(keep)
+			if err != nil {
 				return err
 			}
+			pending = append(pending, buf...)
+			pos = matchStart
 		}
+
 		// Before copying from old file, we have to verify we got an exact match
-		dstbuf, err := g.readN(matchSize)
+		dstbuf, err := content.readN(matchSize - skip)
+		if err != nil {
+			return err
+		}
+		pos += matchSize - skip
+		source, offset, err := g.verifyMatch(match, skip, dstbuf)
 		if err != nil {
 			return err
 		}
-		srcbuf, err := g.readSourceData(source, match.from.offset, matchSize)
+		if source == nil {
+			// None of the candidates were the same, crc32 is a LIER!
+			pending = append(pending, dstbuf...)
+			continue
+		}
+
+		// Extend the match backwards into the data before it
+		back, err := g.matchBackward(source, offset, pending)
 		if err != nil {
 			return err
 		}
-		if bytes.Equal(dstbuf, srcbuf) {
-			// The chunks were actually equal, crc32 never lies!
-			if err := g.deltaWriter.CopyFileAt(uint64(match.from.offset), uint64(match.from.size)); err != nil {
+		if err := deltaWriter.WriteContent(pending[:int64(len(pending))-back]); err != nil {
+			return err
+		}
+		pending = nil
+		offset -= back
+		size := back + int64(len(dstbuf))
+
+		// And forwards, for as long as it matches
+		for g.analysis.sourceData != nil && pos < file.size && offset+size < source.file.size {
+			n := min64(g.options.avgChunkSize, min64(file.size-pos, source.file.size-offset-size))
+			buf, err := content.readN(n)
+			if err != nil {
 				return err
 			}
-		} else {
-			// Bufs where not the same, crc32 is a LIER!
-			if err := g.deltaWriter.WriteContent(dstbuf); err != nil {
+			pos += n
+			srcbuf, err := g.readSourceData(source, offset+size, n)
+			if err != nil {
 				return err
 			}
+			l := commonPrefix(buf, srcbuf)
+			size += l
+			if l < n {
+				pending = append(pending, buf[l:]...)
+				break
+			}
 		}
-		pos = matchStart + matchSize
+
+		// With several sources, this switches files in the middle of the new file
+		if err := deltaWriter.SetCurrentFile(source.file); err != nil {
+			return err
+		}
+		if err := deltaWriter.CopyFileAt(uint64(offset), uint64(size)); err != nil {
+			return err
+		}
+	}
+	if err := deltaWriter.WriteContent(pending); err != nil {
+		return err
 	}
 	// Copy any remainder after last match
 	if pos < file.size {
-		if err := g.copyN(file.size - pos); err != nil {
+		if err := content.copyN(file.size - pos); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+type encodingCandidate struct {
+	encoding FileEncoding
+	encode   func(deltaWriter *deltaWriter) error
+}
+
+// Encodes the file with each of the candidates into a scratch writer, and
+// writes the one with the smallest compressed size to the delta
+func (g *deltaGenerator) encodeSmallest(candidates []encodingCandidate) (FileEncoding, int64, error) {
+	var best *deltaWriter
+	var bestEncoding FileEncoding
+	var bestSize int64
+	for _, candidate := range candidates {
+		scratch, err := g.deltaWriter.newScratchWriter(g.options)
+		if err != nil {
+			return "", 0, err
+		}
+		if err := candidate.encode(scratch); err != nil {
+			scratch.Close()
+			return "", 0, err
+		}
+		size, err := scratch.finishScratch()
+		if err != nil {
+			return "", 0, err
+		}
+		if best == nil || size < bestSize {
+			best, bestEncoding, bestSize = scratch, candidate.encoding, size
+		}
+	}
+	return bestEncoding, bestSize, g.deltaWriter.writeRecorded(best)
+}
+
+// Tries bsdiff on the transformed executables, and uses it if that is
+// smaller than plain bsdiff
+func (g *deltaGenerator) generateForFileWithTransform(info *targetInfo) (FileEncoding, int64, error) {
+	oldData, newData, err := g.readFileData(info)
+	if err != nil {
+		return "", 0, err
+	}
+	return g.encodeSmallest([]encodingCandidate{
+		{EncodingBsdiff, func(w *deltaWriter) error {
+			return encodeBsdiff(g.ctx, w, info.source.file, oldData, newData, common.TransformNone)
+		}},
+		// This modifies the data, so it must be last
+		{EncodingTransformedBsdiff, func(w *deltaWriter) error {
+			return encodeBsdiff(g.ctx, w, info.source.file, oldData, newData, info.file.transform)
+		}},
+	})
+}
+
+// Tries all the encodings that apply to the file, and uses the smallest
+func (g *deltaGenerator) generateForFileBestOf(info *targetInfo, useBsdiff bool, useTransform bool) (FileEncoding, int64, error) {
+	newData, err := g.readN(info.file.size)
+	if err != nil {
+		return "", 0, err
+	}
+	candidates := []encodingCandidate{
+		{EncodingLiteral, func(w *deltaWriter) error {
+			return w.WriteContent(newData)
+		}},
+	}
+	if info.rollsumMatches != nil && len(info.rollsumMatches.matches) > 0 {
+		candidates = append(candidates, encodingCandidate{EncodingRollsum, func(w *deltaWriter) error {
+			return g.generateForFileWithrollsums(info, &memoryContent{data: newData, deltaWriter: w}, w)
+		}})
+	}
+	if useBsdiff {
+		oldData, err := g.readSourceData(info.source, 0, info.source.file.size)
+		if err != nil {
+			return "", 0, err
+		}
+		candidates = append(candidates, encodingCandidate{EncodingBsdiff, func(w *deltaWriter) error {
+			return encodeBsdiff(g.ctx, w, info.source.file, oldData, newData, common.TransformNone)
+		}})
+		if useTransform {
+			// This modifies the data, so it must be last
+			candidates = append(candidates, encodingCandidate{EncodingTransformedBsdiff, func(w *deltaWriter) error {
+				return encodeBsdiff(g.ctx, w, info.source.file, oldData, newData, info.file.transform)
+			}})
+		}
+	}
+	return g.encodeSmallest(candidates)
+}
+
 func (g *deltaGenerator) generateForFile(info *targetInfo) error {
 	file := info.file
 	sourceFile := info.source.file
+	report := FileReport{
+		Path:       file.path,
+		Size:       file.size,
+		SourcePath: sourceFile.path,
+	}
 
 	maxBsdiffSize := g.options.maxBsdiffSize
-
-	if sourceFile.sha1 == file.sha1 && sourceFile.size == file.size {
+	useBsdiff := maxBsdiffSize == 0 || (file.size < maxBsdiffSize && sourceFile.size < maxBsdiffSize)
+	// bsdiff needs the old data, which we don't have when diffing from a signature only
+	useBsdiff = useBsdiff && g.analysis.sourceData != nil
+	// bsdiff can only use one source, so prefer rollsums if most matches are from others
+	multiSource := info.rollsumMatches != nil && info.rollsumMatches.otherSize > info.rollsumMatches.matchSize/2
+	useTransform := g.options.transformExecutables && file.transform != common.TransformNone && file.transform == sourceFile.transform
+
+	var err error
+	if sourceFile.digest == file.digest && sourceFile.size == file.size {
 		// Reuse exact file from old tar
-		if err := g.deltaWriter.WriteOldFile(sourceFile.path, uint64(sourceFile.size)); err != nil {
-			return err
-		}
-
-		if err := g.skipRest(); err != nil {
+		report.Encoding = EncodingOldFile
+		if err := g.deltaWriter.WriteOldFile(sourceFile); err != nil {
 			return err
 		}
-	} else if maxBsdiffSize == 0 || (file.size < maxBsdiffSize && sourceFile.size < maxBsdiffSize) {
+		err = g.skipRest()
+	} else if g.options.bestOf && (maxBsdiffSize == 0 || file.size < maxBsdiffSize) {
+		// Best-of keeps the whole file and each encoding of it in memory, so
+		// it is limited to the same sizes as bsdiff
+		report.Encoding, report.EncodedSize, err = g.generateForFileBestOf(info, useBsdiff, useTransform)
+	} else if multiSource {
+		report.Encoding = EncodingRollsum
+		err = g.generateForFileWithrollsums(info, g, g.deltaWriter)
+	} else if useBsdiff && useTransform {
+		// Use bsdiff, on the transformed executables if that helps
+		report.Encoding, report.EncodedSize, err = g.generateForFileWithTransform(info)
+	} else if useBsdiff {
 		// Use bsdiff to generate delta
-		if err := g.generateForFileWithBsdiff(info); err != nil {
-			return err
-		}
+		report.Encoding = EncodingBsdiff
+		err = g.generateForFileWithBsdiff(info)
 	} else if info.rollsumMatches != nil && info.rollsumMatches.matchRatio > 20 {
 		// Use rollsums to generate delta
-		if err := g.generateForFileWithrollsums(info); err != nil {
-			return err
-		}
+		report.Encoding = EncodingRollsum
+		err = g.generateForFileWithrollsums(info, g, g.deltaWriter)
 	} else {
-		if err := g.copyRest(); err != nil {
-			return err
-		}
+		report.Encoding = EncodingLiteral
+		err = g.copyRest()
+	}
+	if err != nil {
+		return err
 	}
+
+	if report.Encoding == EncodingLiteral {
+		report.SourcePath = ""
+	}
+	g.report(&report)
+	return nil
+}
+
+// Copies the content of a file from its earlier duplicate in the output
+func (g *deltaGenerator) generateForDuplicate(info *targetInfo) error {
+	file := info.file
+	report := FileReport{
+		Path:     file.path,
+		Size:     file.size,
+		Encoding: EncodingDuplicate,
+	}
+	ok, err := g.deltaWriter.CopyOutput(uint64(info.duplicate.offset), uint64(file.size))
+	if err != nil {
+		return err
+	}
+	if ok {
+		report.SourcePath = info.duplicate.path
+		err = g.skipRest()
+	} else {
+		// The duplicate is in an earlier frame
+		report.Encoding = EncodingLiteral
+		err = g.copyRest()
+	}
+	if err != nil {
+		return err
+	}
+	g.report(&report)
 	return nil
 }
 
-func generateDelta(newFile io.ReadSeeker, deltaFile io.Writer, analysis *deltaAnalysis, options *Options) error {
+func (g *deltaGenerator) report(report *FileReport) {
+	if g.options.fileReport != nil {
+		g.options.fileReport(report)
+	}
+}
+
+func generateDelta(ctx context.Context, newFile io.ReadSeeker, deltaFile io.Writer, analysis *deltaAnalysis, info *common.DeltaInfo, options *Options) error {
 	tarFile, _, err := compression.AutoDecompress(newFile)
 	if err != nil {
 		return err
 	}
 	defer tarFile.Close()
 
-	deltaWriter, err := newDeltaWriter(deltaFile, options.compressionLevel)
+	deltaWriter, err := newDeltaWriter(deltaFile, info, options)
 	if err != nil {
 		return err
 	}
 	defer deltaWriter.Close()
 
-	stealingTarFile := newStealerReader(tarFile, deltaWriter)
+	progress := newProgressReporter(options, ProgressGenerate, info.TarSize)
+	stealingTarFile := newStealerReader(io.TeeReader(tarFile, progress), deltaWriter)
 	tarReader := tar.NewReader(stealingTarFile)
 
 	g := &deltaGenerator{
+		ctx:             ctx,
 		stealingTarFile: stealingTarFile,
 		tarReader:       tarReader,
 		analysis:        analysis,
@@ -213,8 +512,11 @@ func generateDelta(newFile io.ReadSeeker, deltaFile io.Writer, analysis *deltaAn
 	}
 
 	for index := 0; true; index++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		g.setSkip(false)
-		_, err := g.tarReader.Next()
+		hdr, err := g.tarReader.Next()
 		if err != nil {
 			if err == io.EOF {
 				// Expected error
@@ -224,11 +526,34 @@ func generateDelta(newFile io.ReadSeeker, deltaFile io.Writer, analysis *deltaAn
 			}
 		}
 
+		typeflag := hdr.Typeflag
+		if isSparseFile(hdr) {
+			// The tar stream doesn't contain the plain file data
+			typeflag = tar.TypeGNUSparse
+		}
+		deltaWriter.AddTOCEntry(common.TOCEntry{
+			Name:     hdr.Name,
+			Linkname: hdr.Linkname,
+			Typeflag: typeflag,
+			Mode:     hdr.Mode,
+			Size:     hdr.Size,
+			Offset:   stealingTarFile.Pos(),
+		})
+
 		info := g.analysis.targetInfoByIndex[index]
-		if info != nil && info.source != nil {
+		if info != nil {
+			progress.setFile(info.file.path)
+		}
+		if info != nil && info.duplicate != nil {
+			if err := g.generateForDuplicate(info); err != nil {
+				return err
+			}
+		} else if info != nil && info.source != nil {
 			if err := g.generateForFile(info); err != nil {
 				return err
 			}
+		} else if info != nil {
+			g.report(&FileReport{Path: info.file.path, Size: info.file.size, Encoding: EncodingLiteral})
 		}
 	}
 	// Steal any remaining data left by tar reader
@@ -244,13 +569,53 @@ func generateDelta(newFile io.ReadSeeker, deltaFile io.Writer, analysis *deltaAn
 	if err != nil {
 		return err
 	}
+	progress.done()
 
 	return nil
 }
 
+// How the content of a file in the new tarfile is encoded in the delta
+type FileEncoding string
+
+const (
+	EncodingOldFile           FileEncoding = "old-file" // An unchanged file from the old tarfile
+	EncodingBsdiff            FileEncoding = "bsdiff"
+	EncodingTransformedBsdiff FileEncoding = "bsdiff-transformed"
+	EncodingRollsum           FileEncoding = "rollsum"
+	EncodingLiteral           FileEncoding = "literal"
+	EncodingDuplicate         FileEncoding = "duplicate" // A copy of an earlier file in the new tarfile
+)
+
+// FileReport describes how a regular file in the new tarfile was encoded
+type FileReport struct {
+	Path       string
+	Size       int64
+	SourcePath string // The old file it was diffed against, or the earlier duplicate, if any
+	Encoding   FileEncoding
+	// The estimated compressed size in the delta, only set when several
+	// encodings were tried
+	EncodedSize int64
+}
+
 type Options struct {
-	compressionLevel int
-	maxBsdiffSize    int64
+	compressionLevel  int
+	maxBsdiffSize     int64
+	recordCompression bool
+	frameSize         int64
+	sourceByDigest    bool
+	recordSources     bool
+
+	transformExecutables bool
+	bestOf               bool
+	maxSources           int
+	dedupWindow          int64
+	strongHash           bool
+	chunker              Chunker
+	minChunkSize         int64
+	avgChunkSize         int64
+	maxChunkSize         int64
+	fileReport           func(*FileReport)
+	progress             func(ProgressEvent)
 }
 
 func (o *Options) SetCompressionLevel(compressionLevel int) {
@@ -261,26 +626,136 @@ func (o *Options) SetMaxBsdiffFileSize(maxBsdiffSize int64) {
 	o.maxBsdiffSize = maxBsdiffSize
 }
 
+// If enabled, try to detect the exact compressor used for the new tarfile
+// and record it in the delta, so that tar-patch can reproduce the original
+// compressed file. This requires the new tarfile to implement io.ReaderAt
+func (o *Options) SetRecordCompression(recordCompression bool) {
+	o.recordCompression = recordCompression
+}
+
+// If non-zero, split the delta into independently decodable frames of about
+// this many bytes of output each. This allows resuming an interrupted apply.
+func (o *Options) SetFrameSize(frameSize int64) {
+	o.frameSize = frameSize
+}
+
+// If enabled, source files are referenced by the sha256 digest of their
+// content instead of by path, so the delta can be applied with a
+// DataSource that looks up files by digest, such as tar_patch.CASDataSource.
+// Such deltas need a tar-patch that supports version 2 of the format.
+func (o *Options) SetSourceByDigest(sourceByDigest bool) {
+	o.sourceByDigest = sourceByDigest
+}
+
+// If enabled (the default), the delta lists the old files it needs, with
+// their sizes and digests. This lets tar-patch check that they are all
+// present and unmodified, at the cost of a slightly larger delta.
+func (o *Options) SetRecordSources(recordSources bool) {
+	o.recordSources = recordSources
+}
+
+// If enabled, x86 and ARM64 ELF executables are also diffed after
+// converting relative call targets to absolute ones, which makes code that
+// moved between versions look the same. This is used for the files where
+// it gives a smaller delta. Such deltas need a tar-patch that supports
+// version 2 of the format.
+func (o *Options) SetTransformExecutables(transformExecutables bool) {
+	o.transformExecutables = transformExecutables
+}
+
+// If enabled, each changed file is encoded in all the applicable ways
+// (bsdiff, rollsums or literal data), and the one with the smallest
+// compressed size is used. This is slower, but avoids e.g. bsdiff output
+// that is larger than the file for compressed or encrypted data. Files
+// larger than the maximum bsdiff file size are encoded as usual.
+func (o *Options) SetBestOf(bestOf bool) {
+	o.bestOf = bestOf
+}
+
+// Called for each regular file in the new tarfile, with how it was encoded
+func (o *Options) SetFileReport(fileReport func(*FileReport)) {
+	o.fileReport = fileReport
+}
+
+// Called with the progress of each phase of Diff, see ProgressEvent
+func (o *Options) SetProgress(progress func(ProgressEvent)) {
+	o.progress = progress
+}
+
+// The number of old files a new file can be diffed against, defaults to 1.
+// With more, rollsum matching uses the blobs of the old files that share
+// the most content with the new file, switching between them within the
+// file. New files without a source by name can then also use the old
+// file with the most similar content. This helps with files that are
+// concatenated or generated from many others.
+func (o *Options) SetMaxSources(maxSources int) {
+	o.maxSources = maxSources
+}
+
+// If non-zero, new files with the same content as an earlier file in the
+// new tarfile, at most this many bytes back, are copied from that earlier
+// output instead of being diffed. tar-patch keeps this much of the output
+// in memory when applying such deltas, which need a tar-patch that
+// supports version 2 of the format.
+func (o *Options) SetDedupWindow(dedupWindow int64) {
+	o.dedupWindow = dedupWindow
+}
+
+// If enabled, rollsum blobs are matched by a sha256 digest as well as by
+// CRC, so that CRC collisions don't count as matches when choosing how
+// to diff a file. This makes analyzing the tarfiles slower.
+func (o *Options) SetStrongHash(strongHash bool) {
+	o.strongHash = strongHash
+}
+
+// The chunker that splits files into blobs for rollsum matching, this
+// defaults to ChunkerRollsum
+func (o *Options) SetChunker(chunker Chunker) {
+	o.chunker = chunker
+}
+
+// The min, average and max size of the blobs that files are split into
+// for rollsum matching, which default to 0, 8KB and 32KB. The average is
+// rounded down to a power of two. Larger blobs are faster to match and
+// use less memory, which suits very large files, while smaller blobs find
+// more of the unchanged data in small files.
+func (o *Options) SetChunkSizes(minSize int64, avgSize int64, maxSize int64) {
+	o.minChunkSize = minSize
+	o.avgChunkSize = avgSize
+	o.maxChunkSize = maxSize
+}
+
 func NewOptions() *Options {
 	return &Options{
+		chunker:          ChunkerRollsum,
+		minChunkSize:     defaultMinBlobSize,
+		avgChunkSize:     defaultAvgBlobSize,
+		maxChunkSize:     defaultMaxBlobSize,
+		maxSources:       1,
 		compressionLevel: 3,
 		maxBsdiffSize:    defaultMaxBsdiffSize,
+		recordSources:    true,
 	}
 }
 
 func Diff(oldTarFile io.ReadSeeker, newTarFile io.ReadSeeker, diffFile io.Writer, options *Options) error {
+	return DiffContext(context.Background(), oldTarFile, newTarFile, diffFile, options)
+}
+
+// Like Diff, but stops and returns the error of ctx if it is cancelled.
+// This is checked between the files of the tarfiles, and while bsdiff runs.
+func DiffContext(ctx context.Context, oldTarFile io.ReadSeeker, newTarFile io.ReadSeeker, diffFile io.Writer, options *Options) error {
 
 	if options == nil {
 		options = NewOptions()
 	}
 
-	// First analyze both tarfiles by themselves
-	oldInfo, err := analyzeTar(oldTarFile)
-	if err != nil {
+	if err := checkChunker(options.chunker, options.minChunkSize, options.avgChunkSize, options.maxChunkSize); err != nil {
 		return err
 	}
 
-	newInfo, err := analyzeTar(newTarFile)
+	// First analyze the old tarfile by itself
+	oldInfo, err := analyzeTar(ctx, oldTarFile, options, ProgressAnalyzeOld)
 	if err != nil {
 		return err
 	}
@@ -290,20 +765,116 @@ func Diff(oldTarFile io.ReadSeeker, newTarFile io.ReadSeeker, diffFile io.Writer
 	if err != nil {
 		return err
 	}
+
+	return diffFrom(ctx, newLayerSignature(oldInfo, options), func(ctx context.Context, sourceByIndex map[int]*sourceInfo, dest *os.File, options *Options) error {
+		return extractDeltaData(ctx, oldTarFile, sourceByIndex, dest, options)
+	}, newTarFile, diffFile, options)
+}
+
+// Like Diff, but with the old tarfile already analyzed by AnalyzeTar. The
+// new tarfile is split into blobs with the chunker options of the
+// signature. oldTarFile is read once, for the content of the files that
+// the delta is computed from, and must be the tarfile the signature was
+// made from.
+//
+// oldTarFile can be nil, e.g. for a signature from AnalyzeFS, to diff
+// from the signature alone. Changed files are then only encoded as copies
+// of the matching rollsum blobs, as bsdiff needs the old data, and the
+// signature must have strong hashes to make sure the blobs really match.
+func DiffWithSignature(oldSignature *LayerSignature, oldTarFile io.Reader, newTarFile io.ReadSeeker, diffFile io.Writer, options *Options) error {
+	return DiffWithSignatureContext(context.Background(), oldSignature, oldTarFile, newTarFile, diffFile, options)
+}
+
+// Like DiffWithSignature, but stops and returns the error of ctx if it is
+// cancelled, see DiffContext
+func DiffWithSignatureContext(ctx context.Context, oldSignature *LayerSignature, oldTarFile io.Reader, newTarFile io.ReadSeeker, diffFile io.Writer, options *Options) error {
+
+	if options == nil {
+		options = NewOptions()
+	}
+	if oldTarFile == nil {
+		if !oldSignature.strongHash {
+			return fmt.Errorf("Diffing without the old tarfile needs a signature with strong hashes")
+		}
+		return diffFrom(ctx, oldSignature, nil, newTarFile, diffFile, options)
+	}
+	return diffFrom(ctx, oldSignature, func(ctx context.Context, sourceByIndex map[int]*sourceInfo, dest *os.File, options *Options) error {
+		return extractDeltaData(ctx, oldTarFile, sourceByIndex, dest, options)
+	}, newTarFile, diffFile, options)
+}
+
+// Like Diff, but with the old files in a directory tree, like an extracted
+// old tarfile. Files are matched by their paths relative to the root, so
+// tar-patch can apply the delta to the same directory.
+func DiffFS(oldFS fs.FS, newTarFile io.ReadSeeker, diffFile io.Writer, options *Options) error {
+	return DiffFSContext(context.Background(), oldFS, newTarFile, diffFile, options)
+}
+
+// Like DiffFS, but stops and returns the error of ctx if it is cancelled,
+// see DiffContext
+func DiffFSContext(ctx context.Context, oldFS fs.FS, newTarFile io.ReadSeeker, diffFile io.Writer, options *Options) error {
+
+	if options == nil {
+		options = NewOptions()
+	}
+
+	// First analyze the old files by themselves
+	oldSignature, err := AnalyzeFSContext(ctx, oldFS, options)
+	if err != nil {
+		return err
+	}
+
+	return diffFrom(ctx, oldSignature, func(ctx context.Context, sourceByIndex map[int]*sourceInfo, dest *os.File, options *Options) error {
+		return extractDeltaDataFS(ctx, oldFS, sourceByIndex, dest, options)
+	}, newTarFile, diffFile, options)
+}
+
+func diffFrom(ctx context.Context, oldSignature *LayerSignature, extract extractFunc, newTarFile io.ReadSeeker, diffFile io.Writer, options *Options) error {
+	options = oldSignature.chunkingOptions(options)
+	oldInfo := oldSignature.info
+
+	newInfo, err := analyzeTar(ctx, newTarFile, options, ProgressAnalyzeNew)
+	if err != nil {
+		return err
+	}
+
+	deltaInfo := &common.DeltaInfo{
+		TarSize:   newInfo.size,
+		TarDigest: newInfo.digest,
+	}
+	if options.dedupWindow != 0 {
+		// Copies never reach further back than the start of the tarfile
+		deltaInfo.OutputWindow = options.dedupWindow
+		if deltaInfo.OutputWindow > newInfo.size {
+			deltaInfo.OutputWindow = newInfo.size
+		}
+	}
+	if options.recordCompression {
+		deltaInfo.Compression, err = detectCompression(newTarFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Reset tar.gz for re-reading
 	_, err = newTarFile.Seek(0, 0)
 	if err != nil {
 		return err
 	}
 
 	// Compare new and old for delta information
-	analysis, err := analyzeForDelta(oldInfo, newInfo, oldTarFile)
+	analysis, err := analyzeForDelta(ctx, oldInfo, newInfo, extract, options)
 	if err != nil {
-		return nil
+		return err
 	}
 	defer analysis.Close()
 
+	if options.recordSources {
+		deltaInfo.Sources = analysis.requiredSources()
+	}
+
 	// Actually create the delta
-	if err := generateDelta(newTarFile, diffFile, analysis, options); err != nil {
+	if err := generateDelta(ctx, newTarFile, diffFile, analysis, deltaInfo, options); err != nil {
 		return err
 	}
 
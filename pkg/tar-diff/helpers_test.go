@@ -0,0 +1,21 @@
+package tar_diff
+
+import (
+	"io"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tar-patch"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func applyToFiles(delta io.Reader, oldFiles map[string][]byte, dst io.Writer) error {
+	return tar_patch.Apply(delta, tar_patch.NewMapDataSource(oldFiles), dst)
+}
+
+// Diffs the layers, and checks that applying the delta recreates the new tarfile
+func diffAndApply(t testing.TB, layers *tartest.Layers, options *Options) []byte {
+	t.Helper()
+	return layers.DiffAndApply(t, func(oldTar io.ReadSeeker, newTar io.ReadSeeker, delta io.Writer) error {
+		return Diff(oldTar, newTar, delta, options)
+	}, applyToFiles)
+}
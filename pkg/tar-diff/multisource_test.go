@@ -0,0 +1,36 @@
+package tar_diff
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestMultipleSources(t *testing.T) {
+	var oldEntries []tartest.Entry
+	var bundle []byte
+	for i := 0; i < 5; i++ {
+		module := tartest.RandomData(int64(i), 128*1024)
+		oldEntries = append(oldEntries, tartest.File(fmt.Sprintf("src/module%d.js", i), module))
+		bundle = append(bundle, fmt.Sprintf("// module %d\n", i)...)
+		bundle = append(bundle, module...)
+	}
+	layers := tartest.BuildLayers(t, oldEntries, []tartest.Entry{tartest.File("dist/bundle.js", bundle)})
+
+	for _, bestOf := range []bool{false, true} {
+		for _, maxSources := range []int{1, 5} {
+			options := NewOptions()
+			options.SetMaxSources(maxSources)
+			options.SetBestOf(bestOf)
+			delta := diffAndApply(t, layers, options)
+
+			if maxSources == 1 && len(delta) < len(bundle) {
+				t.Errorf("best-of %v: expected the bundle as literal data with one source, delta is %d", bestOf, len(delta))
+			}
+			if maxSources > 1 && len(delta) > len(bundle)/10 {
+				t.Errorf("best-of %v: delta with %d sources is too large, %d", bestOf, maxSources, len(delta))
+			}
+		}
+	}
+}
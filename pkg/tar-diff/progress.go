@@ -0,0 +1,75 @@
+package tar_diff
+
+// How often progress is reported, in bytes processed
+const progressInterval = 1024 * 1024
+
+// The phases of Diff, in the order they run
+type ProgressPhase string
+
+const (
+	ProgressAnalyzeOld ProgressPhase = "analyze-old" // Reading the old tarfile or directory
+	ProgressAnalyzeNew ProgressPhase = "analyze-new" // Reading the new tarfile
+	ProgressExtract    ProgressPhase = "extract"     // Copying the old files to diff against to a temporary file
+	ProgressGenerate   ProgressPhase = "generate"    // Writing the delta
+)
+
+// ProgressEvent is passed to the progress callback set with
+// Options.SetProgress when a phase starts, for each file, every megabyte of
+// data, and when the phase ends
+type ProgressEvent struct {
+	Phase ProgressPhase
+	// Bytes of uncompressed data processed in the phase so far
+	Bytes int64
+	// Bytes the phase will process, or 0 if not known. At the end of the
+	// phase, this is always equal to Bytes.
+	Total int64
+	// The file being processed, if any
+	File string
+}
+
+type progressReporter struct {
+	callback func(ProgressEvent)
+	event    ProgressEvent
+	next     int64
+}
+
+// Starts a phase, reporting to the callback in options
+func newProgressReporter(options *Options, phase ProgressPhase, total int64) *progressReporter {
+	p := &progressReporter{
+		callback: options.progress,
+		event:    ProgressEvent{Phase: phase, Total: total},
+	}
+	p.report()
+	return p
+}
+
+func (p *progressReporter) report() {
+	if p.callback != nil {
+		p.callback(p.event)
+	}
+	p.next = p.event.Bytes + progressInterval
+}
+
+func (p *progressReporter) setFile(file string) {
+	p.event.File = file
+	p.report()
+}
+
+// Counts the data processed, for use with io.TeeReader or io.MultiWriter
+func (p *progressReporter) Write(data []byte) (int, error) {
+	p.event.Bytes += int64(len(data))
+	if p.event.Bytes >= p.next {
+		p.report()
+	}
+	return len(data), nil
+}
+
+func (p *progressReporter) done() {
+	p.event.File = ""
+	if p.event.Total != 0 {
+		p.event.Bytes = p.event.Total
+	} else {
+		p.event.Total = p.event.Bytes
+	}
+	p.report()
+}
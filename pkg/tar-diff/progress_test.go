@@ -0,0 +1,49 @@
+package tar_diff
+
+import (
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestProgress(t *testing.T) {
+	big := tartest.RandomData(1, 3*1024*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("big", big),
+		tartest.File("small", []byte("old\n")),
+	}, []tartest.Entry{
+		tartest.File("big", tartest.Modify(big, 100000)),
+		tartest.File("small", []byte("new\n")),
+	})
+
+	var events []ProgressEvent
+	options := NewOptions()
+	options.SetProgress(func(e ProgressEvent) {
+		events = append(events, e)
+	})
+	diffAndApply(t, layers, options)
+
+	phases := []ProgressPhase{ProgressAnalyzeOld, ProgressAnalyzeNew, ProgressExtract, ProgressGenerate}
+	phase := -1
+	var last ProgressEvent
+	for _, e := range events {
+		if phase < 0 || e.Phase != phases[phase] {
+			if phase >= 0 && last.Bytes != last.Total {
+				t.Errorf("Phase %s ended at %d of %d bytes", last.Phase, last.Bytes, last.Total)
+			}
+			phase++
+			if phase >= len(phases) || e.Phase != phases[phase] {
+				t.Fatalf("Unexpected phase %s", e.Phase)
+			}
+		} else if e.Bytes < last.Bytes {
+			t.Errorf("Progress of %s went backwards", e.Phase)
+		}
+		last = e
+	}
+	if phase != len(phases)-1 || last.Bytes != int64(len(layers.New)) || last.Total != last.Bytes {
+		t.Errorf("Wrong last event %v", last)
+	}
+	if len(events) < 8 {
+		t.Errorf("Expected more events, got %d", len(events))
+	}
+}
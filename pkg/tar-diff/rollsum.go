@@ -1,13 +1,24 @@
 package tar_diff
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"hash"
 	"hash/crc32"
+	"math/bits"
 	"sort"
+
+	"github.com/containers/tar-diff/pkg/common"
 )
 
 const (
-	maxBlobSize = 8192 * 4
+	defaultMinBlobSize = 0
+	defaultAvgBlobSize = 8192
+	defaultMaxBlobSize = 8192 * 4
+
+	// Smallest supported average blob size
+	minAvgBlobSize = 64
 
 	// According to librsync/rollsum.h:
 	// "We should make this something other than zero to improve the
@@ -16,16 +27,63 @@ const (
 	// slightly worse than the librsync value of 31 for my arbitrary test data.
 	bupCharOffset = 31
 
-	bupBlobBits   = 13
-	bupBlobSize   = (1 << bupBlobBits)
 	bupWindowBits = 7
 	bupWindowSize = (1 << bupWindowBits)
+
+	// Max number of old blobs tried for each new blob, this keeps files
+	// with lots of identical blobs (like zeros) from taking forever
+	maxMatchCandidates = 4
+)
+
+// Chunker selects how files are split into blobs for rollsum matching
+type Chunker string
+
+const (
+	// The rolling checksum used by bup, over a 128 byte window
+	ChunkerRollsum Chunker = "rollsum"
+	// FastCDC, using a gear hash with normalized chunking. This is faster
+	// than the bup rollsum, and gives blob sizes closer to the average.
+	ChunkerFastCDC Chunker = "fastcdc"
 )
 
+// Random values for the gear hash, the same ones in every run
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64
+	x := uint64(0x2545f4914f6cdd1d)
+	for i := range gearTable {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+func checkChunker(chunker Chunker, minSize, avgSize, maxSize int64) error {
+	if chunker != ChunkerRollsum && chunker != ChunkerFastCDC {
+		return fmt.Errorf("Unknown chunker %s", chunker)
+	}
+	if minSize < 0 || avgSize < minAvgBlobSize || minSize > avgSize || avgSize > maxSize {
+		return fmt.Errorf("Invalid chunk sizes, min %d, average %d, max %d", minSize, avgSize, maxSize)
+	}
+	return nil
+}
+
 type rollsumBlob struct {
 	offset int64
 	size   int64
 	crc32  uint32
+	strong []byte // sha256, if enabled
+}
+
+// Whether the blobs probably have the same content
+func (b *rollsumBlob) sameAs(other *rollsumBlob) bool {
+	if b.size != other.size || b.crc32 != other.crc32 {
+		return false
+	}
+	return b.strong == nil || other.strong == nil || bytes.Equal(b.strong, other.strong)
 }
 
 type rollsum struct {
@@ -33,11 +91,25 @@ type rollsum struct {
 	blobStart int64
 	blobSize  int64
 	blobCrc   hash.Hash32
+	// Only set if strong hashes are enabled
+	blobStrong hash.Hash
+
+	// Blob size limits, and the average as a power of two
+	minSize int64
+	avgSize int64
+	maxSize int64
 
 	// rolling sum to track when to split blob off
 	s1, s2 uint32
 	window [bupWindowSize]byte
 	wofs   int32
+	mask   uint32
+
+	// Or the gear hash for FastCDC, with the masks for before and after the average size
+	gear      bool
+	gearHash  uint64
+	maskSmall uint64
+	maskLarge uint64
 
 	// Resulting blobs
 	header []byte
@@ -52,20 +124,42 @@ func (r *rollsum) add(drop byte, add byte) {
 
 func (r *rollsum) roll(ch byte) {
 	r.blobSize += 1
+	if r.gear {
+		r.gearHash = (r.gearHash << 1) + gearTable[ch]
+		return
+	}
 	r.add(r.window[r.wofs], ch)
 	r.window[r.wofs] = ch
 	r.wofs = (r.wofs + 1) % bupWindowSize
 }
 
 func (r *rollsum) shouldSplit() bool {
-	return r.blobSize == maxBlobSize ||
-		(r.s2&(bupBlobSize-1)) == (^uint32(0)&(bupBlobSize-1))
+	if r.blobSize < r.minSize {
+		return false
+	}
+	if r.blobSize >= r.maxSize {
+		return true
+	}
+	if r.gear {
+		// Splitting is less likely before the average size and more
+		// likely after it, so sizes are closer to the average
+		mask := r.maskLarge
+		if r.blobSize < r.avgSize {
+			mask = r.maskSmall
+		}
+		return r.gearHash&mask == 0
+	}
+	return (r.s2 & r.mask) == r.mask
 }
 
 func (r *rollsum) init() {
 	r.blobStart = r.blobStart + r.blobSize
 	r.blobSize = 0
 	r.blobCrc = crc32.NewIEEE()
+	if r.blobStrong != nil {
+		r.blobStrong.Reset()
+	}
+	r.gearHash = 0
 	r.s1 = bupWindowSize * bupCharOffset
 	r.s2 = bupWindowSize * (bupWindowSize - 1) * bupCharOffset
 	r.wofs = 0
@@ -76,13 +170,31 @@ func (r *rollsum) init() {
 
 func (r *rollsum) addBlob() {
 	blob := rollsumBlob{offset: r.blobStart, size: r.blobSize, crc32: r.blobCrc.Sum32()}
+	if r.blobStrong != nil {
+		blob.strong = r.blobStrong.Sum(nil)
+	}
 	r.blobs = append(r.blobs, blob)
 	r.init()
 }
 
-func newRollsum() *rollsum {
+// Creates a rollsum with the chunker and hashes from options
+func newRollsum(options *Options) *rollsum {
 	r := new(rollsum)
-	r.header = make([]byte, 0, 16)
+	if options.strongHash {
+		r.blobStrong = sha256.New()
+	}
+	avgBits := bits.Len64(uint64(options.avgChunkSize)) - 1
+	r.minSize = options.minChunkSize
+	r.avgSize = int64(1) << avgBits
+	r.maxSize = options.maxChunkSize
+	r.mask = uint32(r.avgSize - 1)
+	if options.chunker == ChunkerFastCDC {
+		// The top bits of the hash depend on the most bytes
+		r.gear = true
+		r.maskSmall = ^uint64(0) << (64 - (avgBits + 1))
+		r.maskLarge = ^uint64(0) << (64 - (avgBits - 1))
+	}
+	r.header = make([]byte, 0, common.TransformHeaderSize)
 	r.blobs = make([]rollsumBlob, 0)
 	r.init()
 	return r
@@ -128,43 +240,61 @@ func (r *rollsum) Write(p []byte) (nn int, err error) {
 			if err != nil {
 				return
 			}
+			if r.blobStrong != nil {
+				r.blobStrong.Write(p[start : i+1])
+			}
 			start = i + 1
 			r.addBlob()
 		}
 	}
 	if start < nn {
 		_, err = r.blobCrc.Write(p[start:nn])
+		if r.blobStrong != nil {
+			r.blobStrong.Write(p[start:nn])
+		}
 	}
 	return
 }
 
-func makeCrcMap(blobs []rollsumBlob) map[uint32][]*rollsumBlob {
-	blobsMap := make(map[uint32][]*rollsumBlob)
-	for i := range blobs {
-		b := &blobs[i]
+// A blob in one of the old files
+type sourceBlob struct {
+	source *sourceInfo
+	blob   *rollsumBlob
+}
 
-		a := blobsMap[b.crc32]
-		a = append(a, b)
-		blobsMap[b.crc32] = a
+func makeCrcMap(sources []*sourceInfo) map[uint32][]sourceBlob {
+	blobsMap := make(map[uint32][]sourceBlob)
+	for _, source := range sources {
+		blobs := source.file.blobs
+		for i := range blobs {
+			b := &blobs[i]
+			blobsMap[b.crc32] = append(blobsMap[b.crc32], sourceBlob{source, b})
+		}
 	}
 	return blobsMap
 }
 
 type rollsumMatch struct {
-	from *rollsumBlob
-	to   *rollsumBlob
+	// All the old blobs that seem to match, preferred first. They are
+	// verified in order, as the CRC can collide.
+	candidates []sourceBlob
+	to         *rollsumBlob
 }
 type rollsumMatches struct {
 	matches    []rollsumMatch
 	matchRatio int
 	matchSize  int64
+	otherSize  int64 // The part of matchSize from other sources than the first
 }
 
-func computeRollsumMatches(from []rollsumBlob, to []rollsumBlob) *rollsumMatches {
-	fromByCrc := makeCrcMap(from)
+// Matches the blobs of a new file against the blobs of one or more old
+// files. Earlier sources are preferred when several match.
+func computeRollsumMatches(sources []*sourceInfo, to []rollsumBlob) *rollsumMatches {
+	fromByCrc := makeCrcMap(sources)
 
 	nMatches := 0
 	matchSize := int64(0)
+	otherSize := int64(0)
 	matches := make([]rollsumMatch, 0)
 
 	for i := range to {
@@ -174,16 +304,21 @@ func computeRollsumMatches(from []rollsumBlob, to []rollsumBlob) *rollsumMatches
 			continue
 		}
 
+		var candidates []sourceBlob
 		for j := range fs {
-			f := fs[j]
-			// If same crc but different length, skip it
-			if f.size == t.size {
-				// Size and crc matches, assume an exact hit but verify when actually computing delta
-				nMatches++
-				matchSize += f.size
-				matches = append(matches, rollsumMatch{f, t})
-				break
+			// Skip blobs with the same crc but different length or strong hash
+			if fs[j].blob.sameAs(t) && len(candidates) < maxMatchCandidates {
+				candidates = append(candidates, fs[j])
+			}
+		}
+		if len(candidates) > 0 {
+			// Size and crc matches, assume an exact hit but verify when actually computing delta
+			nMatches++
+			matchSize += t.size
+			if candidates[0].source != sources[0] {
+				otherSize += t.size
 			}
+			matches = append(matches, rollsumMatch{candidates, t})
 		}
 	}
 
@@ -191,9 +326,50 @@ func computeRollsumMatches(from []rollsumBlob, to []rollsumBlob) *rollsumMatches
 		return matches[i].to.offset < matches[j].to.offset
 	})
 
+	matchRatio := 0
+	if len(to) > 0 {
+		matchRatio = nMatches * 100 / len(to)
+	}
 	return &rollsumMatches{
 		matches:    matches,
-		matchRatio: nMatches * 100 / len(to),
+		matchRatio: matchRatio,
 		matchSize:  matchSize,
+		otherSize:  otherSize,
+	}
+}
+
+// Returns up to k old files sharing the most data with the new file,
+// by the size of the matching blobs
+func findSimilarSources(blobsByCrc map[uint32][]sourceBlob, file *tarFileInfo, exclude *sourceInfo, k int) []*sourceInfo {
+	shared := make(map[*sourceInfo]int64)
+	counted := make(map[*sourceInfo]bool)
+	for i := range file.blobs {
+		t := &file.blobs[i]
+		// Count each source only once per blob
+		for s := range counted {
+			delete(counted, s)
+		}
+		for _, f := range blobsByCrc[t.crc32] {
+			if f.source != exclude && !counted[f.source] && f.blob.sameAs(t) {
+				shared[f.source] += t.size
+				counted[f.source] = true
+			}
+		}
+	}
+
+	similar := make([]*sourceInfo, 0, len(shared))
+	for s := range shared {
+		similar = append(similar, s)
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		a, b := similar[i], similar[j]
+		if shared[a] != shared[b] {
+			return shared[a] > shared[b]
+		}
+		return a.file.index < b.file.index
+	})
+	if len(similar) > k {
+		similar = similar[:k]
 	}
+	return similar
 }
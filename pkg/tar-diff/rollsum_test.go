@@ -0,0 +1,183 @@
+package tar_diff
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+// Makes layers with a big file, where the new file has a small insertion
+// every spacing bytes
+func makeInsertionsLayers(t testing.TB, size int, spacing int) *tartest.Layers {
+	old := tartest.RandomData(1, size)
+	var new []byte
+	for i := 0; i < len(old); i += spacing {
+		end := i + spacing
+		if end > len(old) {
+			end = len(old)
+		}
+		new = append(new, old[i:end]...)
+		new = append(new, fmt.Sprintf("change %d", i)...)
+	}
+	return tartest.BuildLayers(t, []tartest.Entry{tartest.File("big", old)}, []tartest.Entry{tartest.File("big", new)})
+}
+
+func TestRollsumMatchCandidates(t *testing.T) {
+	makeSource := func(strong string) *sourceInfo {
+		blob := rollsumBlob{size: 100, crc32: 1}
+		if strong != "" {
+			blob.strong = []byte(strong)
+		}
+		return &sourceInfo{file: &tarFileInfo{blobs: []rollsumBlob{blob}}}
+	}
+
+	// With only CRCs, all the colliding blobs are candidates, in order
+	a, b := makeSource(""), makeSource("")
+	matches := computeRollsumMatches([]*sourceInfo{a, b}, []rollsumBlob{{size: 100, crc32: 1}})
+	if len(matches.matches) != 1 || len(matches.matches[0].candidates) != 2 ||
+		matches.matches[0].candidates[0].source != a || matches.matches[0].candidates[1].source != b {
+		t.Fatalf("Expected both sources as candidates")
+	}
+	if matches.otherSize != 0 {
+		t.Errorf("Expected the match from the first source, got other size %d", matches.otherSize)
+	}
+
+	// Strong hashes rule out the collisions
+	a, b = makeSource("a"), makeSource("b")
+	matches = computeRollsumMatches([]*sourceInfo{a, b}, []rollsumBlob{{size: 100, crc32: 1, strong: []byte("b")}})
+	if len(matches.matches) != 1 || len(matches.matches[0].candidates) != 1 || matches.matches[0].candidates[0].source != b {
+		t.Fatalf("Expected only the source with the same strong hash")
+	}
+	matches = computeRollsumMatches([]*sourceInfo{a, b}, []rollsumBlob{{size: 100, crc32: 1, strong: []byte("c")}})
+	if len(matches.matches) != 0 || matches.matchRatio != 0 {
+		t.Errorf("Expected no matches")
+	}
+}
+
+// A source with a blob repeated in a bucket only counts it once
+func TestFindSimilarSources(t *testing.T) {
+	blob := &rollsumBlob{size: 100, crc32: 1}
+	other := &rollsumBlob{size: 50, crc32: 2}
+	a := &sourceInfo{file: &tarFileInfo{index: 0}}
+	b := &sourceInfo{file: &tarFileInfo{index: 1}}
+	blobsByCrc := map[uint32][]sourceBlob{
+		1: {{a, blob}, {b, blob}, {a, blob}},
+		2: {{b, other}},
+	}
+	file := &tarFileInfo{blobs: []rollsumBlob{*blob, *other}}
+	similar := findSimilarSources(blobsByCrc, file, nil, 1)
+	if len(similar) != 1 || similar[0] != b {
+		t.Fatalf("Expected the source sharing the most data first")
+	}
+	if similar := findSimilarSources(blobsByCrc, file, b, 2); len(similar) != 1 || similar[0] != a {
+		t.Fatalf("Expected only the source that isn't excluded")
+	}
+}
+
+func BenchmarkChunker(b *testing.B) {
+	data := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, chunker := range []Chunker{ChunkerRollsum, ChunkerFastCDC} {
+		for _, avgSize := range []int64{4 * 1024, 8 * 1024, 64 * 1024} {
+			b.Run(fmt.Sprintf("%s/%dk", chunker, avgSize/1024), func(b *testing.B) {
+				options := NewOptions()
+				options.SetChunker(chunker)
+				options.SetChunkSizes(avgSize/4, avgSize, avgSize*4)
+				b.SetBytes(int64(len(data)))
+				nBlobs := 0
+				for i := 0; i < b.N; i++ {
+					r := newRollsum(options)
+					if _, err := r.Write(data); err != nil {
+						b.Fatal(err)
+					}
+					nBlobs = len(r.GetBlobs())
+				}
+				b.ReportMetric(float64(len(data)/nBlobs), "bytes/blob")
+			})
+		}
+	}
+}
+
+// Files over the bsdiff size limit use rollsums, which should only need
+// literal data for the changes, not for the blobs around them
+func TestRollsumExtendMatches(t *testing.T) {
+	layers := makeInsertionsLayers(t, 4*1024*1024, 100*1024)
+	for _, strongHash := range []bool{false, true} {
+		options := NewOptions()
+		options.SetMaxBsdiffFileSize(1024 * 1024)
+		options.SetStrongHash(strongHash)
+		if delta := diffAndApply(t, layers, options); len(delta) > 4*1024 {
+			t.Errorf("Strong hash %v: delta is too large, %d", strongHash, len(delta))
+		}
+	}
+}
+
+func TestChunkers(t *testing.T) {
+	layers := makeInsertionsLayers(t, 4*1024*1024, 100*1024)
+	for _, chunker := range []Chunker{ChunkerRollsum, ChunkerFastCDC} {
+		for _, avgSize := range []int64{1024, 8 * 1024} {
+			options := NewOptions()
+			options.SetMaxBsdiffFileSize(1024 * 1024)
+			options.SetChunker(chunker)
+			options.SetChunkSizes(avgSize/4, avgSize, avgSize*4)
+			if delta := diffAndApply(t, layers, options); len(delta) > 4*1024 {
+				t.Errorf("%s, %d: delta is too large, %d", chunker, avgSize, len(delta))
+			}
+		}
+	}
+
+	options := NewOptions()
+	options.SetChunkSizes(0, 8192, 4096)
+	if err := Diff(bytes.NewReader(layers.Old), bytes.NewReader(layers.New), &bytes.Buffer{}, options); err == nil {
+		t.Errorf("Expected error for invalid chunk sizes")
+	}
+}
+
+// Reports the delta size and time for each chunker. This uses the old and
+// new tarfiles in $TAR_DIFF_BENCH_OLD and $TAR_DIFF_BENCH_NEW if set, with
+// the default bsdiff size limit, and otherwise a generated big file that
+// is always diffed with rollsums.
+func BenchmarkChunkers(b *testing.B) {
+	var oldTar, newTar []byte
+	var maxBsdiffSize int64
+	if oldPath, newPath := os.Getenv("TAR_DIFF_BENCH_OLD"), os.Getenv("TAR_DIFF_BENCH_NEW"); oldPath != "" && newPath != "" {
+		var err error
+		if oldTar, err = ioutil.ReadFile(oldPath); err != nil {
+			b.Fatal(err)
+		}
+		if newTar, err = ioutil.ReadFile(newPath); err != nil {
+			b.Fatal(err)
+		}
+	} else {
+		layers := makeInsertionsLayers(b, 32*1024*1024, 4*1024*1024)
+		oldTar, newTar = layers.Old, layers.New
+		maxBsdiffSize = 1024 * 1024
+	}
+
+	for _, chunker := range []Chunker{ChunkerRollsum, ChunkerFastCDC} {
+		for _, avgSize := range []int64{4 * 1024, 8 * 1024, 64 * 1024, 1024 * 1024} {
+			b.Run(fmt.Sprintf("%s/%dk", chunker, avgSize/1024), func(b *testing.B) {
+				options := NewOptions()
+				if maxBsdiffSize != 0 {
+					options.SetMaxBsdiffFileSize(maxBsdiffSize)
+				}
+				options.SetChunker(chunker)
+				options.SetChunkSizes(avgSize/4, avgSize, avgSize*4)
+				var delta bytes.Buffer
+				for i := 0; i < b.N; i++ {
+					delta.Reset()
+					if err := Diff(bytes.NewReader(oldTar), bytes.NewReader(newTar), &delta, options); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(delta.Len()), "delta-bytes")
+			})
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package tar_diff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+)
+
+const signatureMagic = "tarsig1\n"
+
+// LayerSignature is what Diff needs to know about an old tarfile: the
+// files in it with their sizes and digests, and the rollsum blobs of each
+// file. It can be saved, so that a tarfile that is diffed against many
+// times only needs to be analyzed once.
+type LayerSignature struct {
+	info *tarInfo
+
+	// The options the rollsum blobs were computed with
+	chunker      Chunker
+	minChunkSize int64
+	avgChunkSize int64
+	maxChunkSize int64
+	strongHash   bool
+}
+
+// Size of the uncompressed tarfile
+func (s *LayerSignature) TarSize() int64 {
+	return s.info.size
+}
+
+// sha256 digest of the uncompressed tarfile, like "sha256:<hex>"
+func (s *LayerSignature) TarDigest() string {
+	return s.info.digest
+}
+
+// Returns a copy of options using the chunker options of the signature,
+// so that the new tarfile is split into blobs the same way
+func (s *LayerSignature) chunkingOptions(options *Options) *Options {
+	o := *options
+	o.chunker = s.chunker
+	o.minChunkSize = s.minChunkSize
+	o.avgChunkSize = s.avgChunkSize
+	o.maxChunkSize = s.maxChunkSize
+	o.strongHash = s.strongHash
+	return &o
+}
+
+// Analyzes a (possibly compressed) tarfile, using the chunker and strong
+// hash options for the rollsum blobs
+func AnalyzeTar(tarFile io.Reader, options *Options) (*LayerSignature, error) {
+	return AnalyzeTarContext(context.Background(), tarFile, options)
+}
+
+// Like AnalyzeTar, but stops and returns the error of ctx if it is cancelled
+func AnalyzeTarContext(ctx context.Context, tarFile io.Reader, options *Options) (*LayerSignature, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	if err := checkChunker(options.chunker, options.minChunkSize, options.avgChunkSize, options.maxChunkSize); err != nil {
+		return nil, err
+	}
+	info, err := analyzeTar(ctx, tarFile, options, ProgressAnalyzeOld)
+	if err != nil {
+		return nil, err
+	}
+	return newLayerSignature(info, options), nil
+}
+
+func newLayerSignature(info *tarInfo, options *Options) *LayerSignature {
+	return &LayerSignature{
+		info:         info,
+		chunker:      options.chunker,
+		minChunkSize: options.minChunkSize,
+		avgChunkSize: options.avgChunkSize,
+		maxChunkSize: options.maxChunkSize,
+		strongHash:   options.strongHash,
+	}
+}
+
+// Analyzes the regular files in a directory tree, like an extracted
+// tarfile, using their paths relative to the root. The signature has no
+// tarfile size or digest.
+func AnalyzeFS(fsys fs.FS, options *Options) (*LayerSignature, error) {
+	return AnalyzeFSContext(context.Background(), fsys, options)
+}
+
+// Like AnalyzeFS, but stops and returns the error of ctx if it is cancelled
+func AnalyzeFSContext(ctx context.Context, fsys fs.FS, options *Options) (*LayerSignature, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	if err := checkChunker(options.chunker, options.minChunkSize, options.avgChunkSize, options.maxChunkSize); err != nil {
+		return nil, err
+	}
+	info, err := analyzeFS(ctx, fsys, options)
+	if err != nil {
+		return nil, err
+	}
+	return newLayerSignature(info, options), nil
+}
+
+type signatureWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *signatureWriter) putUvarint(v uint64) {
+	n := binary.PutUvarint(w.buf[:], v)
+	w.w.Write(w.buf[:n])
+}
+
+func (w *signatureWriter) putString(s string) {
+	w.putUvarint(uint64(len(s)))
+	w.w.WriteString(s)
+}
+
+func (w *signatureWriter) putBool(b bool) {
+	if b {
+		w.w.WriteByte(1)
+	} else {
+		w.w.WriteByte(0)
+	}
+}
+
+func SaveSignature(w io.Writer, signature *LayerSignature) error {
+	sw := &signatureWriter{w: bufio.NewWriter(w)}
+	sw.w.WriteString(signatureMagic)
+	sw.putString(string(signature.chunker))
+	sw.putUvarint(uint64(signature.minChunkSize))
+	sw.putUvarint(uint64(signature.avgChunkSize))
+	sw.putUvarint(uint64(signature.maxChunkSize))
+	sw.putBool(signature.strongHash)
+
+	info := signature.info
+	sw.putUvarint(uint64(info.size))
+	sw.putString(info.digest)
+	sw.putUvarint(uint64(len(info.files)))
+	for i := range info.files {
+		f := &info.files[i]
+		sw.putUvarint(uint64(f.index))
+		sw.putString(f.path)
+		sw.putUvarint(uint64(f.size))
+		sw.putUvarint(uint64(f.offset))
+		sw.putString(f.digest)
+		sw.w.WriteByte(f.transform)
+		sw.putBool(f.overwritten)
+		sw.putUvarint(uint64(len(f.blobs)))
+		for j := range f.blobs {
+			b := &f.blobs[j]
+			sw.putUvarint(uint64(b.size))
+			binary.Write(sw.w, binary.LittleEndian, b.crc32)
+			if signature.strongHash {
+				sw.w.Write(b.strong)
+			}
+		}
+	}
+	return sw.w.Flush()
+}
+
+type signatureReader struct {
+	r *bufio.Reader
+}
+
+// Reads a size or count, which must fit in an int64
+func (r *signatureReader) size() (int64, error) {
+	v, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return 0, err
+	}
+	if v >= 1<<62 {
+		return 0, fmt.Errorf("Value %d too large", v)
+	}
+	return int64(v), nil
+}
+
+func (r *signatureReader) bytes(n int64) ([]byte, error) {
+	// Don't trust the size for allocating, the file may be truncated or corrupt
+	var data bytes.Buffer
+	if _, err := io.CopyN(&data, r.r, n); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+func (r *signatureReader) string() (string, error) {
+	n, err := r.size()
+	if err != nil {
+		return "", err
+	}
+	data, err := r.bytes(n)
+	return string(data), err
+}
+
+func (r *signatureReader) bool() (bool, error) {
+	b, err := r.r.ReadByte()
+	if err == nil && b > 1 {
+		err = fmt.Errorf("Invalid flag %d", b)
+	}
+	return b == 1, err
+}
+
+func LoadSignature(r io.Reader) (*LayerSignature, error) {
+	signature, err := loadSignature(&signatureReader{r: bufio.NewReader(r)})
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("Invalid signature: %v", err)
+	}
+	return signature, nil
+}
+
+func loadSignature(r *signatureReader) (*LayerSignature, error) {
+	magic, err := r.bytes(int64(len(signatureMagic)))
+	if err != nil {
+		return nil, err
+	}
+	if string(magic) != signatureMagic {
+		return nil, fmt.Errorf("Unknown signature format")
+	}
+
+	s := &LayerSignature{info: &tarInfo{}}
+	var chunker string
+	if chunker, err = r.string(); err != nil {
+		return nil, err
+	}
+	s.chunker = Chunker(chunker)
+	if s.minChunkSize, err = r.size(); err != nil {
+		return nil, err
+	}
+	if s.avgChunkSize, err = r.size(); err != nil {
+		return nil, err
+	}
+	if s.maxChunkSize, err = r.size(); err != nil {
+		return nil, err
+	}
+	if err := checkChunker(s.chunker, s.minChunkSize, s.avgChunkSize, s.maxChunkSize); err != nil {
+		return nil, err
+	}
+	if s.strongHash, err = r.bool(); err != nil {
+		return nil, err
+	}
+
+	info := s.info
+	if info.size, err = r.size(); err != nil {
+		return nil, err
+	}
+	if info.digest, err = r.string(); err != nil {
+		return nil, err
+	}
+	count, err := r.size()
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < count; i++ {
+		f, err := loadSignatureFile(r, s.strongHash)
+		if err != nil {
+			return nil, err
+		}
+		info.files = append(info.files, *f)
+	}
+	return s, nil
+}
+
+func loadSignatureFile(r *signatureReader, strongHash bool) (*tarFileInfo, error) {
+	var err error
+	var index int64
+	f := &tarFileInfo{}
+	if index, err = r.size(); err != nil {
+		return nil, err
+	}
+	f.index = int(index)
+	if f.path, err = r.string(); err != nil {
+		return nil, err
+	}
+	f.basename = path.Base(f.path)
+	if f.size, err = r.size(); err != nil {
+		return nil, err
+	}
+	if f.offset, err = r.size(); err != nil {
+		return nil, err
+	}
+	if f.digest, err = r.string(); err != nil {
+		return nil, err
+	}
+	if f.transform, err = r.r.ReadByte(); err != nil {
+		return nil, err
+	}
+	if f.overwritten, err = r.bool(); err != nil {
+		return nil, err
+	}
+	count, err := r.size()
+	if err != nil {
+		return nil, err
+	}
+	offset := int64(0)
+	for i := int64(0); i < count; i++ {
+		b := rollsumBlob{offset: offset}
+		if b.size, err = r.size(); err != nil {
+			return nil, err
+		}
+		if err = binary.Read(r.r, binary.LittleEndian, &b.crc32); err != nil {
+			return nil, err
+		}
+		if strongHash {
+			if b.strong, err = r.bytes(32); err != nil {
+				return nil, err
+			}
+		}
+		offset += b.size
+		if offset > f.size {
+			return nil, fmt.Errorf("Blobs larger than file %s", f.path)
+		}
+		f.blobs = append(f.blobs, b)
+	}
+	if offset != f.size {
+		return nil, fmt.Errorf("Blobs don't cover file %s", f.path)
+	}
+	return f, nil
+}
@@ -0,0 +1,143 @@
+package tar_diff
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/containers/tar-diff/pkg/tar-patch"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestSignature(t *testing.T) {
+	big := tartest.RandomData(1, 2*1024*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("README", []byte("old\n")),
+		tartest.File("lib.so", tartest.RandomData(2, 100*1024)),
+		tartest.File("big", big),
+	}, []tartest.Entry{
+		tartest.File("README", []byte("new\n")),
+		tartest.File("lib.so", tartest.Modify(tartest.RandomData(2, 100*1024), 1000)),
+		tartest.File("big", append(big[:1024*1024:1024*1024], "change"...)),
+	})
+
+	for _, chunker := range []Chunker{ChunkerRollsum, ChunkerFastCDC} {
+		options := NewOptions()
+		options.SetMaxBsdiffFileSize(1024 * 1024)
+		options.SetChunker(chunker)
+		options.SetStrongHash(chunker == ChunkerFastCDC)
+		expected := diffAndApply(t, layers, options)
+
+		signature, err := AnalyzeTar(bytes.NewReader(layers.Old), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var saved bytes.Buffer
+		if err := SaveSignature(&saved, signature); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadSignature(bytes.NewReader(saved.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.TarSize() != int64(len(layers.Old)) || loaded.TarDigest() != signature.TarDigest() {
+			t.Errorf("%s: wrong tarfile in loaded signature", chunker)
+		}
+
+		// The new tarfile is split with the chunker of the signature
+		diffOptions := NewOptions()
+		diffOptions.SetMaxBsdiffFileSize(1024 * 1024)
+		var delta bytes.Buffer
+		if err := DiffWithSignature(loaded, bytes.NewReader(layers.Old), bytes.NewReader(layers.New), &delta, diffOptions); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(delta.Bytes(), expected) {
+			t.Errorf("%s: delta from loaded signature differs", chunker)
+		}
+
+		for i := 0; i < saved.Len(); i += 97 {
+			if _, err := LoadSignature(bytes.NewReader(saved.Bytes()[:i])); err == nil {
+				t.Errorf("%s: expected error for signature truncated at %d", chunker, i)
+			}
+		}
+	}
+
+	// Diffing from the wrong old tarfile must fail, not produce a bad delta
+	signature, err := AnalyzeTar(bytes.NewReader(layers.Old), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongTar, err := tartest.Build([]tartest.Entry{
+		tartest.File("README", []byte("old\n")),
+		tartest.File("lib.so", tartest.RandomData(2, 90*1024)),
+		tartest.File("big", big),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wrong := range [][]byte{wrongTar, layers.Old[:len(layers.Old)/2]} {
+		err = DiffWithSignature(signature, bytes.NewReader(wrong), bytes.NewReader(layers.New), &bytes.Buffer{}, nil)
+		if err == nil {
+			t.Errorf("Expected error for old tarfile not matching the signature")
+		}
+	}
+}
+
+func TestSignatureFromFS(t *testing.T) {
+	big := tartest.RandomData(1, 2*1024*1024)
+	newBig := append(append(big[:1024*1024:1024*1024], "inserted"...), big[1024*1024:]...)
+	oldFS := fstest.MapFS{
+		"usr/lib/big":  {Data: big, Mode: 0644},
+		"usr/lib/same": {Data: []byte("same\n"), Mode: 0644},
+		"etc/secret":   {Data: []byte("secret\n"), Mode: 0600},
+	}
+	newTar, err := tartest.Build([]tartest.Entry{
+		tartest.File("usr/lib/big", newBig),
+		tartest.File("usr/lib/same", []byte("same\n")),
+		tartest.File("etc/secret", []byte("secret\n")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := NewOptions()
+	err = DiffWithSignature(signatureOf(t, oldFS, options), nil, bytes.NewReader(newTar), &bytes.Buffer{}, nil)
+	if err == nil {
+		t.Errorf("Expected error diffing from a signature without strong hashes")
+	}
+
+	options.SetStrongHash(true)
+	var delta bytes.Buffer
+	if err := DiffWithSignature(signatureOf(t, oldFS, options), nil, bytes.NewReader(newTar), &delta, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Only the blob with the insertion is stored
+	if delta.Len() > 64*1024 {
+		t.Errorf("Delta is too large, %d", delta.Len())
+	}
+
+	var out bytes.Buffer
+	if err := tar_patch.Apply(bytes.NewReader(delta.Bytes()), tar_patch.NewFSDataSource(oldFS), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), newTar) {
+		t.Errorf("Wrong output")
+	}
+}
+
+// Analyzes fsys and returns the signature after saving and loading it
+func signatureOf(t *testing.T, fsys fstest.MapFS, options *Options) *LayerSignature {
+	signature, err := AnalyzeFS(fsys, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved bytes.Buffer
+	if err := SaveSignature(&saved, signature); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSignature(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
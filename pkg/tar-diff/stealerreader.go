@@ -8,6 +8,7 @@ type stealerReader struct {
 	source  io.Reader
 	stealer io.Writer
 	ignore  bool
+	pos     int64
 }
 
 // This is a wrapper for reader, everything that is read from
@@ -20,6 +21,7 @@ func newStealerReader(source io.Reader, stealer io.Writer) *stealerReader {
 
 func (s *stealerReader) Read(p []byte) (int, error) {
 	n, err := s.source.Read(p)
+	s.pos += int64(n)
 	var writeErr error = nil
 	if !s.ignore && n > 0 {
 		_, writeErr = s.stealer.Write(p[0:n])
@@ -37,3 +39,8 @@ func (s *stealerReader) Read(p []byte) (int, error) {
 func (s *stealerReader) SetIgnore(ignore bool) {
 	s.ignore = ignore
 }
+
+// Returns the number of bytes read from the source so far
+func (s *stealerReader) Pos() int64 {
+	return s.pos
+}
@@ -0,0 +1,43 @@
+package tar_diff
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/common"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestTransform(t *testing.T) {
+	// Mostly opcodes and top bytes, to hit all the corner cases
+	r := rand.New(rand.NewSource(3))
+	data := make([]byte, 100*1024)
+	for i := range data {
+		data[i] = []byte{0xe8, 0xe9, 0x00, 0xff, 0x94, byte(r.Intn(256))}[r.Intn(6)]
+	}
+	for _, transform := range []uint8{common.TransformX86, common.TransformARM64} {
+		transformed := append([]byte{}, data...)
+		common.EncodeTransform(transform, transformed)
+		common.DecodeTransform(transform, transformed)
+		if !bytes.Equal(data, transformed) {
+			t.Errorf("Transform %d is not reversible", transform)
+		}
+	}
+
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("usr/bin/prog", tartest.FakeExecutable(1, 0)),
+	}, []tartest.Entry{
+		tartest.File("usr/bin/prog", tartest.FakeExecutable(1, 1000)),
+	})
+	for _, frameSize := range []int64{0, 16 * 1024} {
+		options := NewOptions()
+		options.SetFrameSize(frameSize)
+		plainDelta := diffAndApply(t, layers, options)
+		options.SetTransformExecutables(true)
+		transformedDelta := diffAndApply(t, layers, options)
+		if len(transformedDelta) >= len(plainDelta) {
+			t.Errorf("frame size %d: transformed delta is not smaller, %d >= %d", frameSize, len(transformedDelta), len(plainDelta))
+		}
+	}
+}
@@ -3,13 +3,28 @@ package tar_patch
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/containers/tar-diff/pkg/common"
 	"github.com/klauspost/compress/zstd"
+	"hash"
 	"io"
-	"os"
+	"io/ioutil"
+	"math"
 	"path"
+	"sync/atomic"
+)
+
+const (
+	addDataChunkSize = 64 * 1024
+
+	// How often applying checks if the context is cancelled, in ops, and
+	// in bytes within large ops
+	cancelCheckOps   = 64
+	cancelCheckBytes = 1024 * 1024
 )
 
 type DataSource interface {
@@ -18,9 +33,12 @@ type DataSource interface {
 	SetCurrentFile(file string) error
 }
 
-type FilesystemDataSource struct {
-	basePath    string
-	currentFile *os.File
+// DigestDataSource is a DataSource that can also open source files by the
+// digest of their content, as referenced by deltas created with
+// tar_diff.Options.SetSourceByDigest()
+type DigestDataSource interface {
+	DataSource
+	SetCurrentFileByDigest(digest string) error
 }
 
 // Cleans up the path lexically
@@ -34,135 +52,517 @@ func cleanPath(pathName string) string {
 	return clean[1:]
 }
 
-func NewFilesystemDataSource(basePath string) *FilesystemDataSource {
-	return &FilesystemDataSource{
-		basePath:    basePath,
-		currentFile: nil,
+// Reads the delta header and the optional delta info, leaving r at the start of the zstd compressed operations
+func readDeltaHeader(r *bufio.Reader) (*common.DeltaInfo, error) {
+	buf := make([]byte, len(common.DeltaHeader))
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf, common.DeltaHeader[:]) && !bytes.Equal(buf, common.DeltaHeaderV2[:]) {
+		return nil, fmt.Errorf("Invalid delta format")
+	}
+
+	magic, err := r.Peek(4)
+	if err != nil || binary.LittleEndian.Uint32(magic) != common.DeltaInfoFrameMagic {
+		return &common.DeltaInfo{}, nil
+	}
+	if _, err := r.Discard(4); err != nil {
+		return nil, err
 	}
+	data, err := common.ReadSkippableFrameData(r)
+	if err != nil {
+		return nil, err
+	}
+	return common.UnmarshalDeltaInfo(data)
+}
+
+func openSourceFile(dataSource DataSource, name string) error {
+	cleanName := cleanPath(name)
+	if len(cleanName) == 0 {
+		return fmt.Errorf("Invalid source name '%v' in tar-diff", name)
+	}
+	return dataSource.SetCurrentFile(cleanName)
 }
 
-func (f *FilesystemDataSource) Close() error {
-	if f.currentFile != nil {
-		err := f.currentFile.Close()
-		f.currentFile = nil
+func openSourceDigest(dataSource DataSource, digest string) error {
+	digestDataSource, ok := dataSource.(DigestDataSource)
+	if !ok {
+		return fmt.Errorf("Delta references source files by digest, which the data source doesn't support")
+	}
+	return digestDataSource.SetCurrentFileByDigest(digest)
+}
 
-		if err != nil {
+// Opens a source file by path or digest, and verifies it if verifier is set
+func openVerifiedSource(dataSource DataSource, name string, byDigest bool, verifier *sourceVerifier) error {
+	if byDigest {
+		if err := openSourceDigest(dataSource, name); err != nil {
 			return err
 		}
+		return verifier.verify(dataSource, name)
 	}
-	return nil
+	if err := openSourceFile(dataSource, name); err != nil {
+		return err
+	}
+	return verifier.verify(dataSource, cleanPath(name))
 }
 
-func (f *FilesystemDataSource) Read(data []byte) (n int, err error) {
-	if f.currentFile == nil {
-		return 0, fmt.Errorf("No current file set")
+// Restores the source file state at the start of a frame
+func openFrameSource(dataSource DataSource, frame *common.FrameInfo, verifier *sourceVerifier) error {
+	var err error
+	if frame.SourceDigest != "" {
+		err = openVerifiedSource(dataSource, frame.SourceDigest, true, verifier)
+	} else if frame.SourceFile != "" {
+		err = openVerifiedSource(dataSource, frame.SourceFile, false, verifier)
+	} else {
+		return nil
 	}
-	return f.currentFile.Read(data)
+	if err != nil {
+		return err
+	}
+	_, err = dataSource.Seek(int64(frame.SourcePosition), io.SeekStart)
+	return err
 }
 
-func (f *FilesystemDataSource) SetCurrentFile(file string) error {
-	if f.currentFile != nil {
-		err := f.currentFile.Close()
-		f.currentFile = nil
-		if err != nil {
-			return nil
-		}
+func newOpDecoder(options *ApplyOptions, decoderOptions ...zstd.DOption) (*zstd.Decoder, error) {
+	if options.maxDecoderMemory != 0 {
+		decoderOptions = append(decoderOptions, zstd.WithDecoderMaxMemory(options.maxDecoderMemory))
 	}
-	currentFile, err := os.Open(f.basePath + "/" + file)
+	return zstd.NewReader(nil, decoderOptions...)
+}
+
+// Decode the zstd compressed delta operations and apply them
+func applyOps(ctx context.Context, delta io.Reader, dataSource DataSource, dst io.Writer, options *ApplyOptions, info *common.DeltaInfo, verifier *sourceVerifier) error {
+	if options == nil {
+		options = NewApplyOptions()
+	}
+	decoder, err := newOpDecoder(options)
 	if err != nil {
 		return err
 	}
-	f.currentFile = currentFile
+	defer decoder.Close()
+
+	if err := decoder.Reset(delta); err != nil {
+		return err
+	}
+	p := newPatcher(dataSource, dst, options)
+	p.ctx = ctx
+	p.verifier = verifier
+	if err := p.setOutputWindow(info.OutputWindow); err != nil {
+		return err
+	}
+	p.setProgress(newProgressReporter(options, info.TarSize, 0), 0)
+	if err := p.execute(bufio.NewReader(decoder)); err != nil {
+		return err
+	}
+	p.updateProgress()
 	return nil
 }
 
-func (f *FilesystemDataSource) Seek(offset int64, whence int) (int64, error) {
-	if f.currentFile == nil {
-		return 0, fmt.Errorf("No current file set")
+type patcher struct {
+	ctx        context.Context
+	dataSource DataSource
+	dst        io.Writer
+	options    *ApplyOptions
+	outputPos  int64
+	openCount  *uint64 // Shared by the frames of framed deltas
+	verifier   *sourceVerifier
+
+	// Set when applying the ops inside a DeltaOpTransform
+	inTransform bool
+
+	// Only the output in the range [rangeStart, rangeEnd) is written to dst
+	rangeStart int64
+	rangeEnd   int64
+
+	// Buffers for DeltaOpAddData
+	addBuf    []byte
+	sourceBuf []byte
+
+	// The earlier output for DeltaOpCopyOutput, if the delta uses it
+	history *outputHistory
+
+	// Shared by the frames of framed deltas, nil if progress isn't reported
+	progress    *progressReporter
+	progressPos int64 // The output before this was added to the progress
+	progressOps int64 // Ops not added to the progress yet
+
+	// Set when the current source couldn't be opened or verified, and the
+	// output using it is fetched with the fallback fetcher instead
+	sourceFailed bool
+	// Output waiting to be fetched, merged into as few requests as possible
+	fallbackStart int64
+	fallbackSize  int64
+}
+
+func newPatcher(dataSource DataSource, dst io.Writer, options *ApplyOptions) *patcher {
+	if options == nil {
+		options = NewApplyOptions()
+	}
+	return &patcher{
+		ctx:        context.Background(),
+		dataSource: dataSource,
+		dst:        dst,
+		options:    options,
+		openCount:  new(uint64),
+		rangeEnd:   math.MaxInt64,
 	}
-	return f.currentFile.Seek(offset, whence)
 }
 
-func Apply(delta io.Reader, dataSource DataSource, dst io.Writer) error {
-	buf := make([]byte, len(common.DeltaHeader))
-	_, err := io.ReadFull(delta, buf)
-	if err != nil {
+// Keeps the last window bytes of output, from the current position, for
+// DeltaOpCopyOutput. This must be called after setting the output range.
+func (p *patcher) setOutputWindow(window int64) error {
+	if window == 0 {
+		return nil
+	}
+	if err := checkLimit(LimitOutputWindow, uint64(window), p.options.maxOutputWindow); err != nil {
 		return err
 	}
-	if !bytes.Equal(buf, common.DeltaHeader[:]) {
-		return fmt.Errorf("Invalid delta format")
+	// All the output is needed for the history, only dst skips to the range
+	p.history = newOutputHistory(p.dst, window, p.outputPos, p.rangeStart)
+	p.dst = p.history
+	p.rangeStart = p.outputPos
+	return nil
+}
+
+func clamp(v, min, max int64) int64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
 	}
+	return v
+}
+
+// Splits the next size bytes of output into the number of bytes before, inside and after the output range
+func (p *patcher) splitOutput(size int64) (int64, int64, int64) {
+	before := clamp(p.rangeStart-p.outputPos, 0, size)
+	after := clamp(p.outputPos+size-p.rangeEnd, 0, size-before)
+	return before, size - before - after, after
+}
 
-	decoder, err := zstd.NewReader(delta)
+// Queues up the output for size bytes using the failed source to be fetched
+func (p *patcher) fallback(size int64) error {
+	before, inside, _ := p.splitOutput(size)
+	start := p.outputPos + before
+	p.outputPos += size
+	if inside == 0 {
+		return nil
+	}
+	if p.fallbackSize != 0 && p.fallbackStart+p.fallbackSize == start {
+		p.fallbackSize += inside
+		return nil
+	}
+	if err := p.flushFallback(); err != nil {
+		return err
+	}
+	p.fallbackStart = start
+	p.fallbackSize = inside
+	return nil
+}
+
+// Fetches any queued output, this must be called before writing more output
+func (p *patcher) flushFallback() error {
+	if p.fallbackSize == 0 {
+		return nil
+	}
+	err := p.options.fallbackFetcher.FetchRange(p.fallbackStart, p.fallbackSize, p.dst)
 	if err != nil {
+		return fmt.Errorf("Error fetching fallback output %d+%d: %v", p.fallbackStart, p.fallbackSize, err)
+	}
+	p.fallbackSize = 0
+	return nil
+}
+
+func (p *patcher) skipSource(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := p.dataSource.Seek(n, io.SeekCurrent)
+	return err
+}
+
+// Check the limits for an op producing size bytes of output
+func (p *patcher) checkOutput(size uint64) error {
+	if size > math.MaxInt64-uint64(p.outputPos) {
+		return fmt.Errorf("Invalid delta op size %d", size)
+	}
+	if err := checkLimit(LimitOpSize, size, p.options.maxOpSize); err != nil {
 		return err
 	}
-	defer decoder.Close()
+	return checkLimit(LimitOutputSize, uint64(p.outputPos)+size, p.options.maxOutputSize)
+}
+
+// Like io.CopyN to dst, but checks the context between chunks, so that
+// large ops can be cancelled
+func (p *patcher) copyN(src io.Reader, n int64) error {
+	for n > 0 {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+		chunk := n
+		if chunk > cancelCheckBytes {
+			chunk = cancelCheckBytes
+		}
+		if _, err := io.CopyN(p.dst, src, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Reads n bytes from the delta and the source, and writes the bytewise sum
+func (p *patcher) addData(r *bufio.Reader, n int64) error {
+	if p.addBuf == nil {
+		p.addBuf = make([]byte, addDataChunkSize)
+		p.sourceBuf = make([]byte, addDataChunkSize)
+	}
+
+	for n > 0 {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+		chunk := int64(len(p.addBuf))
+		if chunk > n {
+			chunk = n
+		}
+		addBytes := p.addBuf[:chunk]
+		if _, err := io.ReadFull(r, addBytes); err != nil {
+			return err
+		}
+		addBytes2 := p.sourceBuf[:chunk]
+		if _, err := io.ReadFull(p.dataSource, addBytes2); err != nil {
+			return err
+		}
+
+		for i := range addBytes {
+			addBytes[i] = addBytes[i] + addBytes2[i]
+		}
+		if _, err := p.dst.Write(addBytes); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Writes size bytes of earlier output at offset again
+func (p *patcher) copyOutput(offset int64, size int64) error {
+	if p.history == nil {
+		return fmt.Errorf("Invalid delta copy from output without an output window")
+	}
+	if err := p.history.check(offset); err != nil {
+		return err
+	}
+	if err := p.flushFallback(); err != nil {
+		return err
+	}
+	if p.addBuf == nil {
+		p.addBuf = make([]byte, addDataChunkSize)
+		p.sourceBuf = make([]byte, addDataChunkSize)
+	}
+
+	// The copy can overlap the output it produces, so copy at most the
+	// distance back at a time
+	_, n, _ := p.splitOutput(size)
+	distance := p.outputPos - offset
+	for n > 0 {
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+		chunk := clamp(n, 0, int64(len(p.addBuf)))
+		if chunk > distance {
+			chunk = distance
+		}
+		buf := p.addBuf[:chunk]
+		p.history.readAt(buf, offset)
+		if _, err := p.dst.Write(buf); err != nil {
+			return err
+		}
+		offset += chunk
+		n -= chunk
+	}
+	p.outputPos += size
+	return nil
+}
+
+// Reports the progress of the output from start, which is the start of
+// the requested range, to progress
+func (p *patcher) setProgress(progress *progressReporter, start int64) {
+	p.progress = progress
+	p.progressPos = clamp(p.outputPos, start, p.rangeEnd)
+}
+
+// Adds the output in the range and the ops since the last update to the progress
+func (p *patcher) updateProgress() {
+	if p.progress == nil {
+		return
+	}
+	pos := clamp(p.outputPos, p.progressPos, p.rangeEnd)
+	p.progress.add(pos-p.progressPos, p.progressOps)
+	p.progressPos = pos
+	p.progressOps = 0
+}
 
-	r := bufio.NewReader(decoder)
+// Apply the (uncompressed) delta operations from r
+func (p *patcher) execute(r *bufio.Reader) error {
+	nextProgress := p.outputPos + progressInterval
+	ops := 0
+	for p.outputPos < p.rangeEnd {
+		if p.outputPos >= nextProgress {
+			p.updateProgress()
+			nextProgress = p.outputPos + progressInterval
+		}
+		if ops%cancelCheckOps == 0 {
+			if err := p.ctx.Err(); err != nil {
+				return err
+			}
+		}
+		ops++
 
-	for {
 		op, err := r.ReadByte()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return decoderError(err, p.options)
 		}
+		p.progressOps++
 
 		size, err := binary.ReadUvarint(r)
 		if err != nil {
-			return err
+			return decoderError(err, p.options)
 		}
 
 		switch op {
 		case common.DeltaOpData:
-			_, err = io.CopyN(dst, r, int64(size))
-			if err != nil {
+			if err := p.checkOutput(size); err != nil {
+				return err
+			}
+			if err := p.flushFallback(); err != nil {
+				return err
+			}
+			before, inside, after := p.splitOutput(int64(size))
+			if _, err := r.Discard(int(before)); err != nil {
+				return decoderError(err, p.options)
+			}
+			if err := p.copyN(r, inside); err != nil {
+				return decoderError(err, p.options)
+			}
+			if _, err := r.Discard(int(after)); err != nil {
+				return decoderError(err, p.options)
+			}
+			p.outputPos += int64(size)
+		case common.DeltaOpOpen, common.DeltaOpOpenDigest:
+			if err := checkLimit(LimitPathLength, size, p.options.maxPathLength); err != nil {
+				return err
+			}
+			openCount := atomic.AddUint64(p.openCount, 1)
+			if err := checkLimit(LimitOpenCount, openCount, p.options.maxOpenCount); err != nil {
 				return err
 			}
-		case common.DeltaOpOpen:
 			nameBytes := make([]byte, size)
 			_, err = io.ReadFull(r, nameBytes)
 			if err != nil {
+				return decoderError(err, p.options)
+			}
+			err = openVerifiedSource(p.dataSource, string(nameBytes), op == common.DeltaOpOpenDigest, p.verifier)
+			p.sourceFailed = err != nil && p.options.fallbackFetcher != nil
+			if err != nil && !p.sourceFailed {
 				return err
 			}
-			name := string(nameBytes)
-			cleanName := cleanPath(name)
-			if len(cleanName) == 0 {
-				return fmt.Errorf("Invalid source name '%v' in tar-diff", name)
+		case common.DeltaOpCopy:
+			if err := p.checkOutput(size); err != nil {
+				return err
 			}
-			err := dataSource.SetCurrentFile(cleanName)
-			if err != nil {
+			if p.sourceFailed {
+				if err := p.fallback(int64(size)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := p.flushFallback(); err != nil {
 				return err
 			}
-		case common.DeltaOpCopy:
-			_, err = io.CopyN(dst, dataSource, int64(size))
-			if err != nil {
+			before, inside, after := p.splitOutput(int64(size))
+			if err := p.skipSource(before); err != nil {
 				return err
 			}
+			if err := p.copyN(p.dataSource, inside); err != nil {
+				return err
+			}
+			if err := p.skipSource(after); err != nil {
+				return err
+			}
+			p.outputPos += int64(size)
 		case common.DeltaOpAddData:
-			addBytes := make([]byte, size)
-			_, err = io.ReadFull(r, addBytes)
-			if err != nil {
+			if err := p.checkOutput(size); err != nil {
 				return err
 			}
-
-			addBytes2 := make([]byte, size)
-			_, err = io.ReadFull(dataSource, addBytes2)
+			if p.sourceFailed {
+				if _, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+					return decoderError(err, p.options)
+				}
+				if err := p.fallback(int64(size)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := p.flushFallback(); err != nil {
+				return err
+			}
+			before, inside, after := p.splitOutput(int64(size))
+			if _, err := r.Discard(int(before)); err != nil {
+				return decoderError(err, p.options)
+			}
+			if err := p.skipSource(before); err != nil {
+				return err
+			}
+			if err := p.addData(r, inside); err != nil {
+				return decoderError(err, p.options)
+			}
+			if _, err := r.Discard(int(after)); err != nil {
+				return decoderError(err, p.options)
+			}
+			if err := p.skipSource(after); err != nil {
+				return err
+			}
+			p.outputPos += int64(size)
+		case common.DeltaOpTransform:
+			if err := p.checkOutput(size); err != nil {
+				return err
+			}
+			transform, err := r.ReadByte()
 			if err != nil {
+				return decoderError(err, p.options)
+			}
+			if err := p.applyTransform(r, transform, int64(size)); err != nil {
 				return err
 			}
-
-			for i := uint64(0); i < size; i++ {
-				addBytes[i] = addBytes[i] + addBytes2[i]
+		case common.DeltaOpCopyOutput:
+			if err := p.checkOutput(size); err != nil {
+				return err
+			}
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return decoderError(err, p.options)
+			}
+			if offset > math.MaxInt64 {
+				return fmt.Errorf("Invalid delta copy from output offset %d", offset)
 			}
-			if _, err := dst.Write(addBytes); err != nil {
+			if err := p.copyOutput(int64(offset), int64(size)); err != nil {
 				return err
 			}
-
 		case common.DeltaOpSeek:
-			_, err = dataSource.Seek(int64(size), 0)
+			if size > math.MaxInt64 {
+				return fmt.Errorf("Invalid delta seek to %d", size)
+			}
+			if p.sourceFailed {
+				continue
+			}
+			_, err = p.dataSource.Seek(int64(size), 0)
 			if err != nil {
 				return err
 			}
@@ -171,5 +571,228 @@ func Apply(delta io.Reader, dataSource DataSource, dst io.Writer) error {
 		}
 	}
 
+	return p.flushFallback()
+}
+
+// Applies the ops inside a DeltaOpTransform, which produce size bytes of
+// transformed output from the transformed current source file
+func (p *patcher) applyTransform(r *bufio.Reader, transform uint8, size int64) error {
+	if p.inTransform {
+		return fmt.Errorf("Invalid nested delta transform")
+	}
+	if err := common.CheckTransform(transform); err != nil {
+		return err
+	}
+
+	sub := newPatcher(nil, nil, p.options)
+	sub.ctx = p.ctx
+	sub.inTransform = true
+	sub.outputPos = p.outputPos
+	sub.rangeStart = p.outputPos
+	sub.rangeEnd = p.outputPos + size
+
+	var source *transformedSource
+	var out bytes.Buffer
+	if p.sourceFailed {
+		// The output is fetched, just skip the ops
+		sub.dataSource = zeroDataSource{}
+		sub.dst = ioutil.Discard
+	} else {
+		pos, err := p.dataSource.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		// The whole source is read into memory, so it's limited like the output
+		sourceSize, err := p.dataSource.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if err := checkLimit(LimitOpSize, uint64(sourceSize), p.options.maxOpSize); err != nil {
+			return err
+		}
+		if _, err := p.dataSource.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(p.dataSource, sourceSize+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) > sourceSize {
+			return fmt.Errorf("Source file grew while reading it for a delta transform")
+		}
+		common.EncodeTransform(transform, data)
+		source = &transformedSource{bytes.NewReader(data)}
+		if _, err := source.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		sub.dataSource = source
+		sub.dst = &out
+	}
+
+	if err := sub.execute(r); err != nil {
+		return err
+	}
+	if sub.outputPos != p.outputPos+size {
+		return fmt.Errorf("Delta transform ops don't match its size %d", size)
+	}
+	if p.sourceFailed {
+		return p.fallback(size)
+	}
+
+	pos, err := source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := p.dataSource.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	data := out.Bytes()
+	common.DecodeTransform(transform, data)
+	before, inside, _ := p.splitOutput(size)
+	if inside > 0 {
+		if err := p.flushFallback(); err != nil {
+			return err
+		}
+		if _, err := p.dst.Write(data[before : before+inside]); err != nil {
+			return err
+		}
+	}
+	p.outputPos += size
+	return nil
+}
+
+// The transformed current file, for the ops inside a DeltaOpTransform
+type transformedSource struct {
+	*bytes.Reader
+}
+
+func (t *transformedSource) SetCurrentFile(file string) error {
+	return fmt.Errorf("Can't open source files inside a delta transform")
+}
+
+func (t *transformedSource) Close() error {
+	return nil
+}
+
+// Reads as zeros, for skipping ops when the source is not available
+type zeroDataSource struct{}
+
+func (z zeroDataSource) Read(data []byte) (int, error) {
+	for i := range data {
+		data[i] = 0
+	}
+	return len(data), nil
+}
+
+func (z zeroDataSource) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (z zeroDataSource) SetCurrentFile(file string) error {
+	return fmt.Errorf("Can't open source files inside a delta transform")
+}
+
+func (z zeroDataSource) Close() error {
+	return nil
+}
+
+// Report zstd window size errors as exceeding the decoder memory limit
+func decoderError(err error, options *ApplyOptions) error {
+	if err == zstd.ErrWindowSizeExceeded {
+		return &LimitError{Limit: LimitDecoderMemory, Max: options.maxDecoderMemory}
+	}
+	return err
+}
+
+func Apply(delta io.Reader, dataSource DataSource, dst io.Writer) error {
+	return ApplyWithOptions(delta, dataSource, dst, nil)
+}
+
+// Like Apply, but with limits on the resources used, for untrusted deltas.
+// If a limit is exceeded, a *LimitError is returned.
+func ApplyWithOptions(delta io.Reader, dataSource DataSource, dst io.Writer, options *ApplyOptions) error {
+	return ApplyContext(context.Background(), delta, dataSource, dst, options)
+}
+
+// Like ApplyWithOptions, but stops and returns the error of ctx if it is
+// cancelled. The output written until then is incomplete.
+//
+// The output is verified against the digest of the new tarfile if it is
+// recorded in the delta.
+func ApplyContext(ctx context.Context, delta io.Reader, dataSource DataSource, dst io.Writer, options *ApplyOptions) error {
+	if options == nil {
+		options = NewApplyOptions()
+	}
+	r := bufio.NewReader(delta)
+	info, err := readDeltaHeader(r)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if err := applyOps(ctx, r, dataSource, io.MultiWriter(dst, h), options, info, options.newSourceVerifier(info)); err != nil {
+		return err
+	}
+	return checkTarDigest(info, h)
+}
+
+// Checks the hash of the output against the digest of the new tarfile, if
+// the delta records it
+func checkTarDigest(info *common.DeltaInfo, h hash.Hash) error {
+	if info.TarDigest == "" {
+		return nil
+	}
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if digest != info.TarDigest {
+		return fmt.Errorf("Reconstructed tarfile doesn't match, expected digest %s, got %s", info.TarDigest, digest)
+	}
+	return nil
+}
+
+// Like Apply, but instead of the tarfile, this writes the original compressed
+// file, recreated using the compressor information recorded in the delta. The
+// result is verified against the digest of the original.
+func ApplyCompressed(delta io.Reader, dataSource DataSource, dst io.Writer) error {
+	return ApplyCompressedWithOptions(delta, dataSource, dst, nil)
+}
+
+// Like ApplyCompressed, but with limits on the resources used, see
+// ApplyWithOptions. The limits and progress count the uncompressed output.
+func ApplyCompressedWithOptions(delta io.Reader, dataSource DataSource, dst io.Writer, options *ApplyOptions) error {
+	return ApplyCompressedContext(context.Background(), delta, dataSource, dst, options)
+}
+
+// Like ApplyCompressedWithOptions, but stops and returns the error of ctx if
+// it is cancelled
+func ApplyCompressedContext(ctx context.Context, delta io.Reader, dataSource DataSource, dst io.Writer, options *ApplyOptions) error {
+	if options == nil {
+		options = NewApplyOptions()
+	}
+	r := bufio.NewReader(delta)
+	info, err := readDeltaHeader(r)
+	if err != nil {
+		return err
+	}
+	if info.Compression == nil {
+		return fmt.Errorf("Delta has no compression information")
+	}
+
+	h := sha256.New()
+	compressor, err := common.NewCompressor(info.Compression, io.MultiWriter(dst, h))
+	if err != nil {
+		return err
+	}
+	err = applyOps(ctx, r, dataSource, compressor, options, info, options.newSourceVerifier(info))
+	closeErr := compressor.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	digest := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if digest != info.Compression.Digest {
+		return fmt.Errorf("Recompressed data doesn't match, expected digest %s, got %s", info.Compression.Digest, digest)
+	}
 	return nil
 }
@@ -0,0 +1,149 @@
+package tar_patch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/common"
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func compress(t *testing.T, info *common.CompressionInfo, data []byte) []byte {
+	var buf bytes.Buffer
+	compressor, err := common.NewCompressor(info, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := compressor.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := compressor.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func diffCompressed(t *testing.T, oldTar []byte, compressed []byte, recordCompression bool) []byte {
+	options := tar_diff.NewOptions()
+	// Diffing with rollsums is enough here, and much faster
+	options.SetMaxBsdiffFileSize(64 * 1024)
+	options.SetRecordCompression(recordCompression)
+	var delta bytes.Buffer
+	if err := tar_diff.Diff(bytes.NewReader(oldTar), bytes.NewReader(compressed), &delta, options); err != nil {
+		t.Fatal(err)
+	}
+	return delta.Bytes()
+}
+
+func TestApplyCompressed(t *testing.T) {
+	// Several pgzip blocks, with both compressible and random data
+	text := tartest.RandomData(2, 1536*1024)
+	for i := range text {
+		text[i] = "abcdefgh \n"[text[i]%10]
+	}
+	random := tartest.RandomData(1, 64*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("text", text[:512*1024]),
+		tartest.File("random", random),
+	}, []tartest.Entry{
+		tartest.File("text", text),
+		tartest.File("random", tartest.Modify(random, 5000)),
+	})
+
+	var tests []common.CompressionInfo
+	for _, level := range []int{1, 6, 9} {
+		tests = append(tests, common.CompressionInfo{Algorithm: common.CompressionGzip, Level: level, Name: "layer.tar", ModTime: 1600000000})
+	}
+	for _, level := range []int{1, 5, 9} {
+		tests = append(tests, common.CompressionInfo{Algorithm: common.CompressionPgzip, Level: level, BlockSize: common.DefaultPgzipBlockSize})
+	}
+
+	for _, test := range tests {
+		name := fmt.Sprintf("%s-%d", test.Algorithm, test.Level)
+		compressed := compress(t, &test, layers.New)
+		delta := diffCompressed(t, layers.Old, compressed, true)
+
+		var out bytes.Buffer
+		if err := ApplyCompressed(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(out.Bytes(), compressed) {
+			t.Errorf("%s: recompressed data differs", name)
+		}
+	}
+
+	// Only the default pgzip block size is detected, so other block sizes
+	// are recorded by hand
+	for _, blockSize := range []int{256 * 1024, 4 * 1024 * 1024} {
+		info := common.CompressionInfo{Algorithm: common.CompressionPgzip, Level: 5, BlockSize: blockSize}
+		compressed := compress(t, &info, layers.New)
+		delta := diffCompressed(t, layers.Old, compressed, true)
+		err := ApplyCompressed(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), "no compression information") {
+			t.Errorf("block size %d: expected no detected compression, got %v", blockSize, err)
+		}
+
+		info.Size = int64(len(compressed))
+		info.Digest = fmt.Sprintf("sha256:%x", sha256.Sum256(compressed))
+		delta = withDeltaInfo(t, delta, func(deltaInfo *common.DeltaInfo) {
+			deltaInfo.Compression = &info
+		})
+		var out bytes.Buffer
+		if err := ApplyCompressed(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &out); err != nil {
+			t.Fatalf("block size %d: %v", blockSize, err)
+		}
+		if !bytes.Equal(out.Bytes(), compressed) {
+			t.Errorf("block size %d: recompressed data differs", blockSize)
+		}
+	}
+
+	delta := diffCompressed(t, layers.Old, compress(t, &tests[0], layers.New), true)
+	for name, test := range map[string]struct {
+		modify func(c *common.CompressionInfo)
+		err    string
+	}{
+		"unsupported": {func(c *common.CompressionInfo) { c.Algorithm = "xz" }, "Unsupported compression algorithm"},
+		"mismatched":  {func(c *common.CompressionInfo) { c.Level = 9 }, "Recompressed data doesn't match"},
+		"digest":      {func(c *common.CompressionInfo) { c.Digest = "sha256:" + strings.Repeat("0", 64) }, "Recompressed data doesn't match"},
+	} {
+		modified := withDeltaInfo(t, delta, func(info *common.DeltaInfo) {
+			test.modify(info.Compression)
+		})
+		err := ApplyCompressed(bytes.NewReader(modified), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{})
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected %q error, got %v", name, test.err, err)
+		}
+	}
+
+	// The options apply to the uncompressed output
+	options := NewApplyOptions()
+	options.SetMaxOutputSize(uint64(len(layers.New)) - 1)
+	err := ApplyCompressedWithOptions(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{}, options)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != LimitOutputSize {
+		t.Errorf("Expected output size limit error, got %v", err)
+	}
+	var progress ProgressEvent
+	options = NewApplyOptions()
+	options.SetProgress(func(e ProgressEvent) {
+		progress = e
+	})
+	if err := ApplyCompressedWithOptions(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{}, options); err != nil {
+		t.Fatal(err)
+	}
+	if progress.OutputBytes != int64(len(layers.New)) {
+		t.Errorf("Expected final progress of %d bytes, got %d", len(layers.New), progress.OutputBytes)
+	}
+
+	// Without recorded compression, only the tarfile can be recreated
+	delta = diffCompressed(t, layers.Old, compress(t, &tests[0], layers.New), false)
+	if err := ApplyCompressed(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{}); err == nil {
+		t.Errorf("Expected error without compression information")
+	}
+	checkApply(t, delta, layers)
+}
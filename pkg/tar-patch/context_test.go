@@ -0,0 +1,110 @@
+package tar_patch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/common"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestApplyContext(t *testing.T) {
+	big := tartest.RandomData(1, 1024*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("small", []byte("old\n")),
+		tartest.File("big", big),
+	}, []tartest.Entry{
+		tartest.File("small", []byte("new\n")),
+		tartest.File("big", tartest.Modify(big, 1000)),
+	})
+	delta := diffAndApply(t, layers, nil)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := ApplyContext(cancelled, bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected cancelled apply, got %v", err)
+	}
+	var out bytes.Buffer
+	if err := ApplyContext(context.Background(), bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &out, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), layers.New) {
+		t.Errorf("Wrong output")
+	}
+}
+
+// Cancels the context after the first write
+type cancellingWriter struct {
+	cancel  context.CancelFunc
+	written int
+}
+
+func (w *cancellingWriter) Write(p []byte) (int, error) {
+	w.written += len(p)
+	w.cancel()
+	return len(p), nil
+}
+
+func TestCancelLargeOp(t *testing.T) {
+	source := make([]byte, 16*1024*1024)
+	delta := makeRawDelta(t, []testOp{
+		{common.DeltaOpOpen, 4, []byte("file")},
+		{common.DeltaOpCopy, uint64(len(source)), nil},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &cancellingWriter{cancel: cancel}
+	err := ApplyContext(ctx, bytes.NewReader(delta), NewMapDataSource(map[string][]byte{"file": source}), out, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancelled apply, got %v", err)
+	}
+	if out.written >= len(source) {
+		t.Errorf("Expected the copy to stop early, wrote %d", out.written)
+	}
+}
+
+func TestFramedApplyContext(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	layers := makeTestData(t, dir, 4, 256*1024)
+	delta := makeTestDelta(t, layers.Old, layers.New, 64*1024)
+	newDataSource := func() (DataSource, error) {
+		return NewFilesystemDataSource(dir), nil
+	}
+	info := &common.CompressionInfo{Algorithm: common.CompressionGzip, Level: 6}
+	compressedDelta := diffCompressed(t, layers.Old, compress(t, info, layers.New), true)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	reader, err := NewReader(bytes.NewReader(delta), int64(len(delta)), NewFilesystemDataSource(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, apply := range map[string]func() error{
+		"compressed": func() error {
+			return ApplyCompressedContext(cancelled, bytes.NewReader(compressedDelta), NewFilesystemDataSource(dir), ioutil.Discard, nil)
+		},
+		"range": func() error {
+			return ApplyRangeContext(cancelled, bytes.NewReader(delta), int64(len(delta)), NewFilesystemDataSource(dir), 0, 1000, ioutil.Discard, nil)
+		},
+		"parallel": func() error {
+			return ApplyParallelContext(cancelled, bytes.NewReader(delta), int64(len(delta)), newDataSource, &bufferWriterAt{}, 2, nil)
+		},
+		"resumable": func() error {
+			return ApplyResumableContext(cancelled, bytes.NewReader(delta), NewFilesystemDataSource(dir), ioutil.Discard, nil, nil, nil)
+		},
+		"reader": func() error {
+			_, err := reader.ReadAtContext(cancelled, make([]byte, 1000), 0)
+			return err
+		},
+	} {
+		if err := apply(); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected cancelled apply, got %v", name, err)
+		}
+	}
+}
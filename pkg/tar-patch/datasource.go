@@ -0,0 +1,221 @@
+package tar_patch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// FSDataSource reads the old files from an fs.FS, such as an embed.FS, a
+// zip file or os.DirFS(). Files that don't implement io.Seeker are read
+// through io.ReaderAt if possible, or else re-opened when seeking
+// backwards.
+type FSDataSource struct {
+	fsys        fs.FS
+	currentName string
+	currentFile fs.File
+	reader      io.ReadSeeker
+}
+
+func NewFSDataSource(fsys fs.FS) *FSDataSource {
+	return &FSDataSource{
+		fsys: fsys,
+	}
+}
+
+func (f *FSDataSource) Close() error {
+	if f.currentFile != nil {
+		err := f.currentFile.Close()
+		f.currentFile = nil
+		f.reader = nil
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FSDataSource) Read(data []byte) (int, error) {
+	if f.reader == nil {
+		return 0, fmt.Errorf("No current file set")
+	}
+	return f.reader.Read(data)
+}
+
+func (f *FSDataSource) SetCurrentFile(file string) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	currentFile, err := f.fsys.Open(file)
+	if err != nil {
+		return err
+	}
+
+	var reader io.ReadSeeker
+	switch r := currentFile.(type) {
+	case io.ReadSeeker:
+		reader = r
+	case io.ReaderAt:
+		info, err := currentFile.Stat()
+		if err != nil {
+			currentFile.Close()
+			return err
+		}
+		reader = io.NewSectionReader(r, 0, info.Size())
+	default:
+		reader = &reopenSeeker{source: f, file: currentFile}
+	}
+
+	f.currentName = file
+	f.currentFile = currentFile
+	f.reader = reader
+	return nil
+}
+
+func (f *FSDataSource) Seek(offset int64, whence int) (int64, error) {
+	if f.reader == nil {
+		return 0, fmt.Errorf("No current file set")
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+// Seeks in files that can only be read sequentially, by skipping forward
+// and re-opening the file to go backwards
+type reopenSeeker struct {
+	source *FSDataSource
+	file   fs.File
+	pos    int64
+}
+
+func (r *reopenSeeker) Read(data []byte) (int, error) {
+	n, err := r.file.Read(data)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *reopenSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		info, err := r.file.Stat()
+		if err != nil {
+			return r.pos, err
+		}
+		offset += info.Size()
+	default:
+		return r.pos, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return r.pos, fmt.Errorf("Negative seek offset")
+	}
+
+	if offset < r.pos {
+		file, err := r.source.fsys.Open(r.source.currentName)
+		if err != nil {
+			return r.pos, err
+		}
+		r.file.Close()
+		r.file = file
+		r.source.currentFile = file
+		r.pos = 0
+	}
+
+	n, err := io.CopyN(ioutil.Discard, r.file, offset-r.pos)
+	r.pos += n
+	if err != nil && err != io.EOF {
+		return r.pos, err
+	}
+	// Like os.File, seeking past the end is allowed, later reads return EOF
+	r.pos = offset
+	return r.pos, nil
+}
+
+// MapDataSource serves the old files from memory, mapping paths (as in the
+// tarfile, without a leading slash) to their content. This is mostly
+// useful for tests.
+type MapDataSource struct {
+	files       map[string][]byte
+	currentFile *bytes.Reader
+}
+
+func NewMapDataSource(files map[string][]byte) *MapDataSource {
+	return &MapDataSource{
+		files: files,
+	}
+}
+
+func (m *MapDataSource) Close() error {
+	m.currentFile = nil
+	return nil
+}
+
+func (m *MapDataSource) Read(data []byte) (int, error) {
+	if m.currentFile == nil {
+		return 0, fmt.Errorf("No current file set")
+	}
+	return m.currentFile.Read(data)
+}
+
+func (m *MapDataSource) SetCurrentFile(file string) error {
+	data, ok := m.files[file]
+	if !ok {
+		return &fs.PathError{Op: "open", Path: file, Err: fs.ErrNotExist}
+	}
+	m.currentFile = bytes.NewReader(data)
+	return nil
+}
+
+func (m *MapDataSource) Seek(offset int64, whence int) (int64, error) {
+	if m.currentFile == nil {
+		return 0, fmt.Errorf("No current file set")
+	}
+	return m.currentFile.Seek(offset, whence)
+}
+
+// CASDataSource reads the old files from a content addressed store, where
+// each file is stored as objects/ab/cdef... under basePath, named by the
+// hex sha256 digest of its content. It can only be used with deltas that
+// reference source files by digest.
+type CASDataSource struct {
+	FilesystemDataSource
+}
+
+func NewCASDataSource(basePath string) *CASDataSource {
+	return NewCASDataSourceWithOptions(basePath, NewFilesystemOptions())
+}
+
+func NewCASDataSourceWithOptions(basePath string, options *FilesystemOptions) *CASDataSource {
+	return &CASDataSource{
+		FilesystemDataSource: *NewFilesystemDataSourceWithOptions(basePath, options),
+	}
+}
+
+// Returns the path of the object for the digest, relative to the store
+func CASObjectPath(digest string) (string, error) {
+	hexDigest := strings.TrimPrefix(digest, "sha256:")
+	if len(hexDigest) != sha256.Size*2 || strings.Trim(hexDigest, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("Invalid source digest '%s' in tar-diff", digest)
+	}
+	return path.Join("objects", hexDigest[:2], hexDigest[2:]), nil
+}
+
+func (c *CASDataSource) SetCurrentFile(file string) error {
+	return fmt.Errorf("Can't open %s by path from a content addressed store", file)
+}
+
+func (c *CASDataSource) SetCurrentFileByDigest(digest string) error {
+	objectPath, err := CASObjectPath(digest)
+	if err != nil {
+		return err
+	}
+	return c.FilesystemDataSource.SetCurrentFile(objectPath)
+}
@@ -0,0 +1,158 @@
+package tar_patch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+// Hides everything but fs.File, to test the seek fallback
+type sequentialFS struct {
+	fsys fs.FS
+}
+
+type sequentialFile struct {
+	fs.File
+}
+
+func (s sequentialFS) Open(name string) (fs.File, error) {
+	f, err := s.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return sequentialFile{f}, nil
+}
+
+func TestFSDataSource(t *testing.T) {
+	data := tartest.RandomData(1, 64*1024)
+	// Reorder and modify the files, so that the delta seeks back and forth
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("dir/a", data),
+		tartest.File("dir/b", tartest.RandomData(2, 32*1024)),
+	}, []tartest.Entry{
+		tartest.File("dir/b", append(tartest.RandomData(2, 32*1024), data[:1000]...)),
+		tartest.File("dir/a", tartest.Modify(data, 3000)),
+	})
+	files := layers.OldFiles()
+	mapFS := fstest.MapFS{}
+	for name, content := range files {
+		mapFS[name] = &fstest.MapFile{Data: content}
+	}
+	delta := makeTestDelta(t, layers.Old, layers.New, 0)
+
+	for name, dataSource := range map[string]DataSource{
+		"map":        NewMapDataSource(files),
+		"fs":         NewFSDataSource(mapFS),
+		"sequential": NewFSDataSource(sequentialFS{mapFS}),
+	} {
+		var out bytes.Buffer
+		if err := Apply(bytes.NewReader(delta), dataSource, &out); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(out.Bytes(), layers.New) {
+			t.Errorf("%s: wrong output", name)
+		}
+
+		if err := dataSource.SetCurrentFile("dir/a"); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 10)
+		for _, pos := range []int64{5000, 100, 64*1024 - 10} {
+			if _, err := dataSource.Seek(pos, io.SeekStart); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if _, err := io.ReadFull(dataSource, buf); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(buf, data[pos:pos+10]) {
+				t.Errorf("%s: wrong data at %d", name, pos)
+			}
+		}
+		if err := dataSource.SetCurrentFile("missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected a not exist error, got %v", name, err)
+		}
+		dataSource.Close()
+	}
+}
+
+func TestCASDataSource(t *testing.T) {
+	data := tartest.RandomData(1, 256*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("usr/lib/a", data),
+		tartest.File("usr/lib/b", tartest.RandomData(2, 100*1024)),
+	}, []tartest.Entry{
+		tartest.File("usr/lib64/b", tartest.RandomData(2, 100*1024)),
+		tartest.File("usr/lib/a", tartest.Modify(data, 3000)),
+	})
+	files := layers.OldFiles()
+
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	for _, content := range files {
+		objectPath, err := CASObjectPath(fmt.Sprintf("sha256:%x", sha256.Sum256(content)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(objectPath)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, objectPath), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, frameSize := range []int64{0, 64 * 1024} {
+		var deltaBuf bytes.Buffer
+		options := tar_diff.NewOptions()
+		options.SetFrameSize(frameSize)
+		options.SetSourceByDigest(true)
+		if err := tar_diff.Diff(bytes.NewReader(layers.Old), bytes.NewReader(layers.New), &deltaBuf, options); err != nil {
+			t.Fatal(err)
+		}
+		delta := deltaBuf.Bytes()
+
+		var out bytes.Buffer
+		if err := Apply(bytes.NewReader(delta), NewCASDataSource(dir), &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), layers.New) {
+			t.Errorf("frame size %d: wrong output", frameSize)
+		}
+
+		if err := Apply(bytes.NewReader(delta), NewMapDataSource(files), ioutil.Discard); err == nil {
+			t.Errorf("frame size %d: expected error with a path based data source", frameSize)
+		}
+
+		if frameSize != 0 {
+			// Frames starting in the middle of a source must restore it by digest
+			out := &bufferWriterAt{}
+			newDataSource := func() (DataSource, error) {
+				return NewCASDataSource(dir), nil
+			}
+			if err := ApplyParallel(bytes.NewReader(delta), int64(len(delta)), newDataSource, out, 3); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.buf, layers.New) {
+				t.Errorf("frame size %d: wrong parallel output", frameSize)
+			}
+		}
+	}
+
+	for _, digest := range []string{"sha256:../../etc/passwd", "sha256:abc", "md5:" + strings.Repeat("0", 64)} {
+		if _, err := CASObjectPath(digest); err == nil {
+			t.Errorf("Expected error for digest %s", digest)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package tar_patch
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestApplyDedup(t *testing.T) {
+	lib := tartest.RandomData(1, 256*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("README", []byte("old\n")),
+	}, []tartest.Entry{
+		tartest.File("app1/lib.so", lib),
+		tartest.File("app1/data", make([]byte, 9*1024*1024)),
+		tartest.File("app2/lib.so", lib),
+		tartest.File("app3/lib.so", lib),
+	})
+
+	options := tar_diff.NewOptions()
+	options.SetDedupWindow(16 * 1024 * 1024)
+	delta := diffAndApply(t, layers, options)
+
+	applyOptions := NewApplyOptions()
+	applyOptions.SetMaxOutputWindow(1024)
+	err := ApplyWithOptions(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{}, applyOptions)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != LimitOutputWindow {
+		t.Errorf("Expected output window limit error, got %v", err)
+	}
+
+	// Copies only reach back within a frame, so ranges need the output
+	// from the start of the frame
+	options.SetFrameSize(512 * 1024)
+	framed := diffAndApply(t, layers, options)
+	r, err := NewReader(bytes.NewReader(framed), int64(len(framed)), NewMapDataSource(layers.OldFiles()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := r.OpenFile("app3/lib.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, len(lib))
+	if _, err := f.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, lib) {
+		t.Errorf("Wrong data for app3/lib.so from framed delta")
+	}
+}
+
+func TestOutputHistory(t *testing.T) {
+	var dst, all bytes.Buffer
+	h := newOutputHistory(&dst, 1000, 100, 150)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		data := make([]byte, rnd.Intn(1500))
+		rnd.Read(data)
+		h.Write(data)
+		all.Write(data)
+
+		end := int64(100 + all.Len())
+		offset := end - 1 - rnd.Int63n(1000)
+		if offset < 100 {
+			offset = 100
+		}
+		if err := h.check(offset); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, end-offset)
+		h.readAt(buf, offset)
+		if !bytes.Equal(buf, all.Bytes()[offset-100:]) {
+			t.Fatalf("Wrong history at %d", offset)
+		}
+	}
+	if h.check(int64(100+all.Len())-1001) == nil {
+		t.Errorf("Expected error for offset outside the window")
+	}
+	if !bytes.Equal(dst.Bytes(), all.Bytes()[50:]) {
+		t.Errorf("Wrong output")
+	}
+}
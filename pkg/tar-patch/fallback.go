@@ -0,0 +1,86 @@
+package tar_patch
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// FallbackFetcher gets parts of the reconstructed (uncompressed) tarfile
+// from somewhere else, for the output that can't be created because a
+// source file is missing or modified.
+type FallbackFetcher interface {
+	// Writes the size bytes of output at offset to dst
+	FetchRange(offset int64, size int64, dst io.Writer) error
+}
+
+// HTTPFallbackFetcher fetches ranges of the output with HTTP range
+// requests. The URL must serve the uncompressed tarfile.
+type HTTPFallbackFetcher struct {
+	url    string
+	client *http.Client
+	header http.Header
+}
+
+func NewHTTPFallbackFetcher(url string) *HTTPFallbackFetcher {
+	return &HTTPFallbackFetcher{
+		url:    url,
+		client: http.DefaultClient,
+		header: make(http.Header),
+	}
+}
+
+func (f *HTTPFallbackFetcher) SetClient(client *http.Client) {
+	f.client = client
+}
+
+// Headers to send with each request, e.g. for authorization
+func (f *HTTPFallbackFetcher) SetHeader(header http.Header) {
+	f.header = header
+}
+
+func (f *HTTPFallbackFetcher) FetchRange(offset int64, size int64, dst io.Writer) error {
+	if size == 0 {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range f.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+size-1))
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Unexpected status fetching range %d+%d from %s: %s", offset, size, f.url, resp.Status)
+	}
+	n, err := io.CopyN(dst, resp.Body, size)
+	if err == io.EOF {
+		return fmt.Errorf("Short read fetching range %d+%d from %s, got %d bytes", offset, size, f.url, n)
+	}
+	return err
+}
+
+// ReaderAtFallbackFetcher fetches ranges of the output from a local copy,
+// mainly for testing
+type ReaderAtFallbackFetcher struct {
+	r io.ReaderAt
+}
+
+func NewReaderAtFallbackFetcher(r io.ReaderAt) *ReaderAtFallbackFetcher {
+	return &ReaderAtFallbackFetcher{r: r}
+}
+
+func (f *ReaderAtFallbackFetcher) FetchRange(offset int64, size int64, dst io.Writer) error {
+	n, err := io.Copy(dst, io.NewSectionReader(f.r, offset, size))
+	if err == nil && n != size {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
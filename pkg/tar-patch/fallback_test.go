@@ -0,0 +1,94 @@
+package tar_patch
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+// Records the fetched ranges
+type countingFetcher struct {
+	FallbackFetcher
+	fetched int64
+}
+
+func (c *countingFetcher) FetchRange(offset int64, size int64, dst io.Writer) error {
+	c.fetched += size
+	return c.FallbackFetcher.FetchRange(offset, size, dst)
+}
+
+func TestFallbackFetcher(t *testing.T) {
+	data := tartest.RandomData(1, 256*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("dir/a", data),
+		tartest.File("dir/b", tartest.RandomData(2, 64*1024)),
+		tartest.File("dir/c", tartest.RandomData(3, 64*1024)),
+	}, []tartest.Entry{
+		tartest.File("dir/a", tartest.Modify(data, 3000)),
+		tartest.File("dir/b2", tartest.RandomData(2, 64*1024)),
+		tartest.File("dir/c", tartest.Modify(tartest.RandomData(3, 64*1024), 5000)),
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "new.tar", time.Time{}, bytes.NewReader(layers.New))
+	}))
+	defer server.Close()
+
+	for _, frameSize := range []int64{0, 64 * 1024} {
+		delta := makeTestDelta(t, layers.Old, layers.New, frameSize)
+		for name, fetcher := range map[string]FallbackFetcher{
+			"local": NewReaderAtFallbackFetcher(bytes.NewReader(layers.New)),
+			"http":  NewHTTPFallbackFetcher(server.URL),
+		} {
+			files := layers.OldFiles()
+			delete(files, "dir/b")
+			files["dir/c"] = tartest.Modify(files["dir/c"], 1000)
+
+			counter := &countingFetcher{FallbackFetcher: fetcher}
+			options := NewApplyOptions()
+			options.SetFallbackFetcher(counter)
+			var out bytes.Buffer
+			if err := ApplyWithOptions(bytes.NewReader(delta), NewMapDataSource(files), &out, options); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(out.Bytes(), layers.New) {
+				t.Errorf("%s, frame size %d: wrong output", name, frameSize)
+			}
+			// Only the data for b and c should be fetched, not a
+			if counter.fetched == 0 || counter.fetched > 2*64*1024 {
+				t.Errorf("%s, frame size %d: unexpected fetched size %d", name, frameSize, counter.fetched)
+			}
+		}
+	}
+
+	fetcher := NewHTTPFallbackFetcher(server.URL + "/missing")
+	if err := fetcher.FetchRange(int64(len(layers.New)), 10, ioutil.Discard); err == nil {
+		t.Errorf("Expected error fetching outside of the file")
+	}
+}
+
+func TestFallbackFetcherWrongData(t *testing.T) {
+	data := tartest.RandomData(1, 64*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("dir/a", data),
+	}, []tartest.Entry{
+		tartest.File("dir/a", tartest.Modify(data, 3000)),
+	})
+	delta := makeTestDelta(t, layers.Old, layers.New, 0)
+
+	files := layers.OldFiles()
+	delete(files, "dir/a")
+	// A fallback with the wrong content must not give a silently corrupt output
+	options := NewApplyOptions()
+	options.SetFallbackFetcher(NewReaderAtFallbackFetcher(bytes.NewReader(tartest.Modify(layers.New, 7))))
+	err := ApplyWithOptions(bytes.NewReader(delta), NewMapDataSource(files), ioutil.Discard, options)
+	if err == nil || !strings.Contains(err.Error(), "Reconstructed tarfile doesn't match") {
+		t.Errorf("Expected output digest mismatch, got %v", err)
+	}
+}
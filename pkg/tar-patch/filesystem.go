@@ -0,0 +1,312 @@
+package tar_patch
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+const (
+	// The initial read-ahead, which doubles while reads are sequential
+	minReadAhead = 4 * 1024
+)
+
+// FilesystemOptions controls how FilesystemDataSource reads the old files.
+// The defaults keep a single file open and read it without buffering.
+type FilesystemOptions struct {
+	maxOpenFiles int
+	readAhead    int
+	mmap         bool
+	digestDir    string
+}
+
+// Number of files kept open, so that going back to a recently used file
+// doesn't reopen it, this defaults to 1
+func (o *FilesystemOptions) SetMaxOpenFiles(maxOpenFiles int) {
+	o.maxOpenFiles = maxOpenFiles
+}
+
+// Maximum size of the read-ahead buffer of each open file, or 0 to read
+// without buffering. The buffer starts small and grows while the reads
+// are sequential, so small seeks and copies only need a system call when
+// they leave the buffered data.
+func (o *FilesystemOptions) SetReadAhead(readAhead int) {
+	o.readAhead = readAhead
+}
+
+// Map the files with fs-verity enabled into memory instead of reading
+// them, where supported. Other files are always read, as truncating a
+// mapped file while it's used would crash the process.
+func (o *FilesystemOptions) SetMmap(mmap bool) {
+	o.mmap = mmap
+}
+
+// Directory where the digests of old files with fs-verity enabled are
+// kept between runs, in files named by their verity digest. Anyone who can
+// write to it can make modified files pass verification, so it must only
+// be writable by the caller. By default the digests are only kept in
+// memory, for the life of the process.
+func (o *FilesystemOptions) SetDigestCacheDir(dir string) {
+	o.digestDir = dir
+}
+
+func NewFilesystemOptions() *FilesystemOptions {
+	return &FilesystemOptions{
+		maxOpenFiles: 1,
+	}
+}
+
+// The sha256 digests of files with fs-verity enabled, by verity digest.
+// Only digests computed by hashing the content are stored, so the cache
+// can't be forged by the owner of the files.
+var verityDigests sync.Map
+
+var validDigest = regexp.MustCompile("^sha256:[0-9a-f]{64}$")
+
+func cachedVerityDigest(dir, verity string) string {
+	if digest, ok := verityDigests.Load(verity); ok {
+		return digest.(string)
+	}
+	if dir == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, verity))
+	if err != nil || !validDigest.Match(data) {
+		return ""
+	}
+	verityDigests.Store(verity, string(data))
+	return string(data)
+}
+
+// Failing to store the digest in dir is not an error, it's only a cache
+func cacheVerityDigest(dir, verity, digest string) {
+	verityDigests.Store(verity, digest)
+	if dir == "" {
+		return
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.WriteString(digest)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, verity))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+type sourceFile struct {
+	name string
+	file *os.File
+	data []byte // Set if the file is mapped
+	size int64  // -1 if not known yet
+	pos  int64
+
+	// Read-ahead buffer, holding the data at bufPos
+	buf     []byte
+	bufData []byte
+	bufPos  int64
+}
+
+func (s *sourceFile) close() error {
+	if s.data != nil {
+		if err := munmapFile(s.data); err != nil {
+			s.file.Close()
+			return err
+		}
+		s.data = nil
+	}
+	return s.file.Close()
+}
+
+func (s *sourceFile) fileSize() (int64, error) {
+	if s.size < 0 {
+		info, err := s.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		s.size = info.Size()
+	}
+	return s.size, nil
+}
+
+// Fills the read-ahead buffer at the current position
+func (s *sourceFile) fill(readAhead int) error {
+	window := minReadAhead
+	if len(s.bufData) != 0 && s.pos == s.bufPos+int64(len(s.bufData)) {
+		window = len(s.bufData) * 2
+	}
+	if window > readAhead {
+		window = readAhead
+	}
+	if len(s.buf) < window {
+		s.buf = make([]byte, window)
+	}
+
+	n, err := s.file.ReadAt(s.buf[:window], s.pos)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		return err
+	}
+	s.bufData = s.buf[:n]
+	s.bufPos = s.pos
+	return nil
+}
+
+func (s *sourceFile) read(data []byte, readAhead int) (int, error) {
+	if s.data != nil {
+		if s.pos >= int64(len(s.data)) {
+			return 0, io.EOF
+		}
+		n := copy(data, s.data[s.pos:])
+		s.pos += int64(n)
+		return n, nil
+	}
+
+	if readAhead == 0 || len(data) >= readAhead {
+		n, err := s.file.ReadAt(data, s.pos)
+		s.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	if s.pos < s.bufPos || s.pos >= s.bufPos+int64(len(s.bufData)) {
+		if err := s.fill(readAhead); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(data, s.bufData[s.pos-s.bufPos:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+// FilesystemDataSource reads the old files from a directory with the
+// extracted old tarfile
+type FilesystemDataSource struct {
+	basePath  string
+	options   *FilesystemOptions
+	openFiles *list.List // Of *sourceFile, most recently used first
+	byName    map[string]*list.Element
+	current   *sourceFile
+}
+
+func NewFilesystemDataSource(basePath string) *FilesystemDataSource {
+	return NewFilesystemDataSourceWithOptions(basePath, NewFilesystemOptions())
+}
+
+func NewFilesystemDataSourceWithOptions(basePath string, options *FilesystemOptions) *FilesystemDataSource {
+	return &FilesystemDataSource{
+		basePath:  basePath,
+		options:   options,
+		openFiles: list.New(),
+		byName:    make(map[string]*list.Element),
+	}
+}
+
+func (f *FilesystemDataSource) Close() error {
+	var firstErr error
+	for e := f.openFiles.Front(); e != nil; e = e.Next() {
+		if err := e.Value.(*sourceFile).close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	f.openFiles.Init()
+	f.byName = make(map[string]*list.Element)
+	f.current = nil
+	return firstErr
+}
+
+func (f *FilesystemDataSource) Read(data []byte) (n int, err error) {
+	if f.current == nil {
+		return 0, fmt.Errorf("No current file set")
+	}
+	return f.current.read(data, f.options.readAhead)
+}
+
+// Closes the least recently used files, leaving room for one more
+func (f *FilesystemDataSource) evict() error {
+	for f.openFiles.Len() > 0 && f.openFiles.Len() >= f.options.maxOpenFiles {
+		s := f.openFiles.Remove(f.openFiles.Back()).(*sourceFile)
+		delete(f.byName, s.name)
+		if err := s.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes file the current file, at position 0. A file that is still open,
+// including the current one, is reused rather than opened again, so a file
+// that is replaced after it's first opened keeps its old content until it's
+// closed to make room for others.
+func (f *FilesystemDataSource) SetCurrentFile(file string) error {
+	if e, ok := f.byName[file]; ok {
+		f.openFiles.MoveToFront(e)
+		f.current = e.Value.(*sourceFile)
+		f.current.pos = 0
+		return nil
+	}
+
+	f.current = nil
+	if err := f.evict(); err != nil {
+		return err
+	}
+	osFile, err := os.Open(f.basePath + "/" + file)
+	if err != nil {
+		return err
+	}
+	s := &sourceFile{
+		name: file,
+		file: osFile,
+		size: -1,
+	}
+	if f.options.mmap && isImmutable(osFile) {
+		// Fall back to reading if the file can't be mapped
+		if size, err := s.fileSize(); err == nil && size > 0 {
+			if data, err := mmapFile(osFile, size); err == nil {
+				s.data = data
+			}
+		}
+	}
+	f.byName[file] = f.openFiles.PushFront(s)
+	f.current = s
+	return nil
+}
+
+func (f *FilesystemDataSource) Seek(offset int64, whence int) (int64, error) {
+	if f.current == nil {
+		return 0, fmt.Errorf("No current file set")
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.current.pos
+	case io.SeekEnd:
+		size, err := f.current.fileSize()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("Invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("Invalid seek to %d", offset)
+	}
+	f.current.pos = offset
+	return offset, nil
+}
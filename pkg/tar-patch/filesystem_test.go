@@ -0,0 +1,286 @@
+package tar_patch
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+var filesystemOptionCases = []struct {
+	name         string
+	maxOpenFiles int
+	readAhead    int
+	mmap         bool
+}{
+	{"default", 1, 0, false},
+	{"lru", 64, 0, false},
+	{"readahead", 1, 128 * 1024, false},
+	{"mmap", 1, 0, true},
+	{"all", 64, 128 * 1024, true},
+}
+
+func newTestFilesystemOptions(maxOpenFiles int, readAhead int, mmap bool) *FilesystemOptions {
+	options := NewFilesystemOptions()
+	options.SetMaxOpenFiles(maxOpenFiles)
+	options.SetReadAhead(readAhead)
+	options.SetMmap(mmap)
+	return options
+}
+
+// Creates tarfiles with many small files that are moved around and modified,
+// with the old files extracted in dir
+func makeSmallFilesData(t testing.TB, dir string, nFiles int) ([]byte, []byte) {
+	var oldEntries, newEntries []tartest.Entry
+	for i := 0; i < nFiles; i++ {
+		data := tartest.RandomData(int64(i), 2*1024+i%7*1024)
+		oldEntries = append(oldEntries, tartest.File(fmt.Sprintf("dir%d/file%d", i%10, i), data))
+		newEntries = append(newEntries, tartest.File(fmt.Sprintf("new/dir%d/file%d", i%10, i), tartest.Modify(data, 500)))
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(newEntries), func(i, j int) {
+		newEntries[i], newEntries[j] = newEntries[j], newEntries[i]
+	})
+
+	oldTar, err := tartest.Build(oldEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTar, err := tartest.Build(newEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := tartest.Extract(oldTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return oldTar, newTar
+}
+
+func TestFilesystemOptions(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	data := tartest.RandomData(1, 300*1024)
+	if err := ioutil.WriteFile(filepath.Join(dir, "big"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "empty"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	oldTar, newTar := makeSmallFilesData(t, dir, 50)
+	delta := makeTestDelta(t, oldTar, newTar, 0)
+
+	for _, c := range filesystemOptionCases {
+		dataSource := NewFilesystemDataSourceWithOptions(dir, newTestFilesystemOptions(c.maxOpenFiles, c.readAhead, c.mmap))
+
+		var out bytes.Buffer
+		if err := Apply(bytes.NewReader(delta), dataSource, &out); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !bytes.Equal(out.Bytes(), newTar) {
+			t.Errorf("%s: wrong output", c.name)
+		}
+
+		// Random reads of different sizes, switching between files
+		r := rand.New(rand.NewSource(2))
+		for i := 0; i < 200; i++ {
+			if err := dataSource.SetCurrentFile("empty"); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := dataSource.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+				t.Fatalf("%s: expected EOF for empty file, got %d, %v", c.name, n, err)
+			}
+			if err := dataSource.SetCurrentFile("big"); err != nil {
+				t.Fatal(err)
+			}
+			pos := r.Int63n(int64(len(data)))
+			if _, err := dataSource.Seek(pos, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, r.Intn(200*1024))
+			n, err := io.ReadFull(dataSource, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+			if !bytes.Equal(buf[:n], data[pos:pos+int64(n)]) || (n < len(buf) && pos+int64(n) != int64(len(data))) {
+				t.Fatalf("%s: wrong data at %d+%d", c.name, pos, len(buf))
+			}
+		}
+		if end, err := dataSource.Seek(-10, io.SeekEnd); err != nil || end != int64(len(data)-10) {
+			t.Errorf("%s: wrong seek from end: %d, %v", c.name, end, err)
+		}
+		if err := dataSource.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func BenchmarkFilesystemDataSource(b *testing.B) {
+	dir := makeTempDir(b)
+	defer os.RemoveAll(dir)
+	oldTar, newTar := makeSmallFilesData(b, dir, 2000)
+	delta := makeTestDelta(b, oldTar, newTar, 0)
+	// Only measure the reading done by the ops
+	applyOptions := NewApplyOptions()
+	applyOptions.SetVerifySources(false)
+
+	for _, c := range filesystemOptionCases {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(int64(len(newTar)))
+			for i := 0; i < b.N; i++ {
+				dataSource := NewFilesystemDataSourceWithOptions(dir, newTestFilesystemOptions(c.maxOpenFiles, c.readAhead, c.mmap))
+				if err := ApplyWithOptions(bytes.NewReader(delta), dataSource, ioutil.Discard, applyOptions); err != nil {
+					b.Fatal(err)
+				}
+				dataSource.Close()
+			}
+		})
+	}
+}
+
+// Small seeks and reads, alternating between a few files, like bsdiff output
+func BenchmarkFilesystemSmallReads(b *testing.B) {
+	dir := makeTempDir(b)
+	defer os.RemoveAll(dir)
+	const nFiles = 8
+	for i := 0; i < nFiles; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(i)), tartest.RandomData(int64(i), 1024*1024), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, c := range filesystemOptionCases {
+		b.Run(c.name, func(b *testing.B) {
+			dataSource := NewFilesystemDataSourceWithOptions(dir, newTestFilesystemOptions(c.maxOpenFiles, c.readAhead, c.mmap))
+			defer dataSource.Close()
+			r := rand.New(rand.NewSource(1))
+			buf := make([]byte, 256)
+			pos := make([]int64, nFiles)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				file := i / 16 % nFiles
+				if i%16 == 0 {
+					if err := dataSource.SetCurrentFile(fmt.Sprint(file)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				pos[file] = (pos[file] + r.Int63n(512)) % (1024*1024 - 256)
+				if _, err := dataSource.Seek(pos[file], io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				n := 16 + r.Intn(240)
+				if _, err := io.ReadFull(dataSource, buf[:n]); err != nil {
+					b.Fatal(err)
+				}
+				pos[file] += int64(n)
+			}
+		})
+	}
+}
+
+func TestVerityDigestCache(t *testing.T) {
+	dir := t.TempDir()
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	cacheVerityDigest(dir, "1-1234", digest)
+	verityDigests.Delete("1-1234")
+	if cached := cachedVerityDigest(dir, "1-1234"); cached != digest {
+		t.Fatalf("Expected %s from the cache dir, got %q", digest, cached)
+	}
+	// Still cached in memory without the dir
+	if cached := cachedVerityDigest("", "1-1234"); cached != digest {
+		t.Fatalf("Expected %s from memory, got %q", digest, cached)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "1-5678"), []byte("sha256:forged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cached := cachedVerityDigest(dir, "1-5678"); cached != "" {
+		t.Fatalf("Expected invalid digest to be ignored, got %q", cached)
+	}
+	if cached := cachedVerityDigest("", "1-9999"); cached != "" {
+		t.Fatalf("Expected no digest, got %q", cached)
+	}
+}
+
+func TestFilesystemReopen(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		// Replaced rather than rewritten, so open handles keep the old content
+		tmp := filepath.Join(dir, "tmp")
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(dataSource DataSource, name string) string {
+		if err := dataSource.SetCurrentFile(name); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(dataSource)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	write("a", "old a")
+	write("b", "b")
+	dataSource := NewFilesystemDataSource(dir)
+	defer dataSource.Close()
+	if data := read(dataSource, "a"); data != "old a" {
+		t.Fatalf("Wrong content %q", data)
+	}
+	write("a", "new a")
+	// Setting the current file again reuses the handle, at position 0
+	if data := read(dataSource, "a"); data != "old a" {
+		t.Fatalf("Expected the open file to be reused from the start, got %q", data)
+	}
+	// With the default of one open file, switching files closes it
+	if data := read(dataSource, "b"); data != "b" {
+		t.Fatalf("Wrong content %q", data)
+	}
+	if data := read(dataSource, "a"); data != "new a" {
+		t.Fatalf("Expected the file to be reopened, got %q", data)
+	}
+}
+
+func TestMmapFile(t *testing.T) {
+	dir := t.TempDir()
+	data := tartest.RandomData(1, 10000)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	mapped, err := mmapFile(file, int64(len(data)))
+	if err != nil {
+		t.Skip(err)
+	}
+	defer munmapFile(mapped)
+	if !bytes.Equal(mapped, data) {
+		t.Fatal("Wrong mapped data")
+	}
+	// Regular files can be truncated, so they must not be mapped
+	if isImmutable(file) {
+		t.Fatal("Expected a regular file not to be immutable")
+	}
+}
@@ -0,0 +1,98 @@
+package tar_patch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+var fuzzNames = []string{"a", "b", "dir/c", "dir/d", "dir/sub/e", "f.so", "g.txt", "h"}
+
+// Builds a tarfile from fuzz data. The data is split into files at each
+// zero byte, and the first byte of each file selects its name.
+func makeFuzzTar(t testing.TB, data []byte) []byte {
+	var entries []tartest.Entry
+	seen := make(map[string]bool)
+	for _, chunk := range bytes.Split(data, []byte{0}) {
+		if len(chunk) == 0 || len(seen) == len(fuzzNames) {
+			continue
+		}
+		name := fuzzNames[int(chunk[0])%len(fuzzNames)]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		entries = append(entries, tartest.File(name, chunk[1:]))
+	}
+	tarData, err := tartest.Build(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tarData
+}
+
+func fuzzApplyOptions() *ApplyOptions {
+	options := NewApplyOptions()
+	options.SetMaxOutputSize(16 * 1024 * 1024)
+	options.SetMaxOpSize(1024 * 1024)
+	options.SetMaxOpenCount(1024)
+	options.SetMaxDecoderMemory(16 * 1024 * 1024)
+	options.SetMaxOutputWindow(16 * 1024 * 1024)
+	return options
+}
+
+func FuzzApply(f *testing.F) {
+	old := []byte("\x00first file content\x00\x01second file content")
+	new := []byte("\x00first file content, changed\x00\x02moved second file content")
+	for _, frameSize := range []int64{0, 16} {
+		f.Add(makeTestDelta(f, makeFuzzTar(f, old), makeFuzzTar(f, new), frameSize))
+	}
+
+	f.Fuzz(func(t *testing.T, delta []byte) {
+		files, err := tartest.Extract(makeFuzzTar(t, []byte("\x00first file content\x00\x01second file content")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only check that invalid deltas don't crash or exceed the limits
+		_ = ApplyWithOptions(bytes.NewReader(delta), NewMapDataSource(files), ioutil.Discard, fuzzApplyOptions())
+		if index, err := ReadDeltaIndex(bytes.NewReader(delta), int64(len(delta))); err == nil && index.OutputSize < 1024*1024 {
+			_ = ApplyRange(bytes.NewReader(delta), int64(len(delta)), NewMapDataSource(files), 0, int64(index.OutputSize), ioutil.Discard)
+		}
+	})
+}
+
+func FuzzDiffApply(f *testing.F) {
+	f.Add([]byte("\x00hello world\x00\x01second file"), []byte("\x00hello there world\x00\x02second file"), int64(0))
+	f.Add([]byte("\x03some data\x00\x04more data"), []byte("\x04some data\x00\x03more data, appended"), int64(8))
+	f.Add([]byte{}, []byte("\x05new file"), int64(0))
+
+	f.Fuzz(func(t *testing.T, oldData []byte, newData []byte, frameSize int64) {
+		if frameSize < 0 || frameSize > 1024*1024 {
+			return
+		}
+		oldTar := makeFuzzTar(t, oldData)
+		newTar := makeFuzzTar(t, newData)
+		files, err := tartest.Extract(oldTar)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var delta bytes.Buffer
+		options := tar_diff.NewOptions()
+		options.SetFrameSize(frameSize)
+		if err := tar_diff.Diff(bytes.NewReader(oldTar), bytes.NewReader(newTar), &delta, options); err != nil {
+			t.Fatal(err)
+		}
+
+		var out bytes.Buffer
+		if err := Apply(bytes.NewReader(delta.Bytes()), NewMapDataSource(files), &out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), newTar) {
+			t.Fatal("Output doesn't match the new tarfile")
+		}
+	})
+}
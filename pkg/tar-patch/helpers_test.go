@@ -0,0 +1,62 @@
+package tar_patch
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/common"
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func makeTestDelta(t testing.TB, oldTar []byte, newTar []byte, frameSize int64) []byte {
+	t.Helper()
+	options := tar_diff.NewOptions()
+	options.SetFrameSize(frameSize)
+	var delta bytes.Buffer
+	if err := tar_diff.Diff(bytes.NewReader(oldTar), bytes.NewReader(newTar), &delta, options); err != nil {
+		t.Fatal(err)
+	}
+	return delta.Bytes()
+}
+
+func applyToFiles(delta io.Reader, oldFiles map[string][]byte, dst io.Writer) error {
+	return Apply(delta, NewMapDataSource(oldFiles), dst)
+}
+
+// Diffs the layers, and checks that applying the delta recreates the new tarfile
+func diffAndApply(t testing.TB, layers *tartest.Layers, options *tar_diff.Options) []byte {
+	t.Helper()
+	return layers.DiffAndApply(t, func(oldTar io.ReadSeeker, newTar io.ReadSeeker, delta io.Writer) error {
+		return tar_diff.Diff(oldTar, newTar, delta, options)
+	}, applyToFiles)
+}
+
+func checkApply(t testing.TB, delta []byte, layers *tartest.Layers) {
+	t.Helper()
+	layers.CheckApply(t, delta, applyToFiles)
+}
+
+// Returns the delta with its info changed by modify. The delta must not
+// be framed, as the offsets in the frame index would be wrong.
+func withDeltaInfo(t testing.TB, delta []byte, modify func(info *common.DeltaInfo)) []byte {
+	t.Helper()
+	r := bufio.NewReader(bytes.NewReader(delta))
+	info, err := readDeltaHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify(info)
+
+	var out bytes.Buffer
+	out.Write(delta[:len(common.DeltaHeader)])
+	if err := common.WriteSkippableFrame(&out, common.DeltaInfoFrameMagic, info.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(&out, r); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,71 @@
+package tar_patch
+
+import (
+	"fmt"
+	"io"
+)
+
+// Keeps the last window bytes of output for DeltaOpCopyOutput, and passes
+// the output from skipUntil on to dst. The buffer grows as needed, so
+// small outputs don't allocate the whole window.
+type outputHistory struct {
+	dst       io.Writer
+	skipUntil int64
+	window    int64
+	buf       []byte
+	start     int64 // Output offset of the first byte recorded
+	pos       int64 // Output offset of the next byte
+}
+
+func newOutputHistory(dst io.Writer, window int64, start int64, skipUntil int64) *outputHistory {
+	return &outputHistory{
+		dst:       dst,
+		skipUntil: skipUntil,
+		window:    window,
+		start:     start,
+		pos:       start,
+	}
+}
+
+func (h *outputHistory) Write(p []byte) (int, error) {
+	if skip := clamp(h.skipUntil-h.pos, 0, int64(len(p))); skip < int64(len(p)) {
+		if _, err := h.dst.Write(p[skip:]); err != nil {
+			return 0, err
+		}
+	}
+
+	data := p
+	if int64(len(data)) > h.window {
+		h.pos += int64(len(data)) - h.window
+		data = data[int64(len(data))-h.window:]
+	}
+	for len(data) > 0 {
+		i := (h.pos - h.start) % h.window
+		if i >= int64(len(h.buf)) {
+			grow := clamp(i+int64(len(data)), 0, h.window) - int64(len(h.buf))
+			h.buf = append(h.buf, make([]byte, grow)...)
+		}
+		n := copy(h.buf[i:], data)
+		data = data[n:]
+		h.pos += int64(n)
+	}
+	return len(p), nil
+}
+
+// Checks that the output at offset is in the history
+func (h *outputHistory) check(offset int64) error {
+	if offset < h.start || offset >= h.pos || h.pos-offset > h.window {
+		return fmt.Errorf("Invalid delta copy from output offset %d", offset)
+	}
+	return nil
+}
+
+// Reads earlier output at offset, which must be in the history
+func (h *outputHistory) readAt(data []byte, offset int64) {
+	for len(data) > 0 {
+		i := (offset - h.start) % h.window
+		n := copy(data, h.buf[i:])
+		data = data[n:]
+		offset += int64(n)
+	}
+}
@@ -0,0 +1,162 @@
+package tar_patch
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/containers/tar-diff/pkg/common"
+	"github.com/klauspost/compress/zstd"
+)
+
+var ErrNoDeltaIndex = errors.New("Delta has no index (not created with a frame size)")
+
+// Reads the frame index at the end of a framed delta
+func ReadDeltaIndex(delta io.ReaderAt, deltaSize int64) (*common.DeltaIndex, error) {
+	if deltaSize < int64(len(common.DeltaHeader))+8+common.DeltaIndexFooterSize {
+		return nil, ErrNoDeltaIndex
+	}
+	footer := make([]byte, common.DeltaIndexFooterSize)
+	if _, err := delta.ReadAt(footer, deltaSize-int64(len(footer))); err != nil {
+		return nil, err
+	}
+	frameSize := int64(common.ParseDeltaIndexFooter(footer))
+	if frameSize < 8+common.DeltaIndexFooterSize || frameSize > deltaSize-int64(len(common.DeltaHeader)) {
+		return nil, ErrNoDeltaIndex
+	}
+
+	frame := make([]byte, frameSize)
+	if _, err := delta.ReadAt(frame, deltaSize-frameSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(frame[0:4]) != common.DeltaIndexFrameMagic ||
+		int64(binary.LittleEndian.Uint32(frame[4:8])) != frameSize-8 {
+		return nil, ErrNoDeltaIndex
+	}
+
+	return common.UnmarshalDeltaIndex(frame[8:])
+}
+
+// Reads the delta info at the start of a delta
+func readDeltaInfoAt(delta io.ReaderAt, deltaSize int64) (*common.DeltaInfo, error) {
+	return readDeltaHeader(bufio.NewReader(io.NewSectionReader(delta, 0, deltaSize)))
+}
+
+// Returns the index of the frame containing the output offset
+func findFrame(index *common.DeltaIndex, offset uint64) int {
+	i := sort.Search(len(index.Frames), func(i int) bool {
+		return index.Frames[i].OutputOffset > offset
+	})
+	return i - 1
+}
+
+// The state for applying the frames of a framed delta, in any order
+type frameApplier struct {
+	delta     io.ReaderAt
+	info      *common.DeltaInfo
+	options   *ApplyOptions
+	openCount uint64 // Shared by all the frames, so updated atomically
+	progress  *progressReporter
+}
+
+func newFrameApplier(delta io.ReaderAt, deltaSize int64, options *ApplyOptions) (*frameApplier, error) {
+	if options == nil {
+		options = NewApplyOptions()
+	}
+	info, err := readDeltaInfoAt(delta, deltaSize)
+	if err != nil {
+		return nil, err
+	}
+	return &frameApplier{
+		delta:   delta,
+		info:    info,
+		options: options,
+	}, nil
+}
+
+// Applies the part of a frame that is inside the range [start, end) of the output
+func (a *frameApplier) applyFrame(ctx context.Context, frame *common.FrameInfo, decoder *zstd.Decoder, dataSource DataSource, verifier *sourceVerifier, start, end int64, dst io.Writer) error {
+	if err := openFrameSource(dataSource, frame, verifier); err != nil {
+		return err
+	}
+
+	if err := decoder.Reset(io.NewSectionReader(a.delta, int64(frame.DeltaOffset), int64(frame.Size))); err != nil {
+		return decoderError(err, a.options)
+	}
+
+	p := newPatcher(dataSource, dst, a.options)
+	p.ctx = ctx
+	p.openCount = &a.openCount
+	p.verifier = verifier
+	p.outputPos = int64(frame.OutputOffset)
+	p.rangeStart = start
+	p.rangeEnd = end
+	if err := p.setOutputWindow(a.info.OutputWindow); err != nil {
+		return err
+	}
+	p.setProgress(a.progress, start)
+	if err := p.execute(bufio.NewReader(decoder)); err != nil {
+		return err
+	}
+	p.updateProgress()
+	return nil
+}
+
+func (a *frameApplier) applyRange(ctx context.Context, index *common.DeltaIndex, dataSource DataSource, verifier *sourceVerifier, offset int64, length int64, dst io.Writer) error {
+	if offset < 0 || length < 0 || uint64(offset+length) > index.OutputSize {
+		return fmt.Errorf("Range %d+%d is outside of the output", offset, length)
+	}
+	if length == 0 {
+		return nil
+	}
+
+	decoder, err := newOpDecoder(a.options)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	first := findFrame(index, uint64(offset))
+	if first < 0 {
+		return fmt.Errorf("Invalid delta index")
+	}
+
+	end := offset + length
+	for i := first; i < len(index.Frames) && index.Frames[i].OutputOffset < uint64(end); i++ {
+		if err := a.applyFrame(ctx, &index.Frames[i], decoder, dataSource, verifier, offset, end, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes length bytes of the output, starting at offset, to dst. This only
+// decodes the frames needed for that part of the output, so the delta must
+// have an index.
+func ApplyRange(delta io.ReaderAt, deltaSize int64, dataSource DataSource, offset int64, length int64, dst io.Writer) error {
+	return ApplyRangeWithOptions(delta, deltaSize, dataSource, offset, length, dst, nil)
+}
+
+// Like ApplyRange, but with limits on the resources used, see ApplyWithOptions
+func ApplyRangeWithOptions(delta io.ReaderAt, deltaSize int64, dataSource DataSource, offset int64, length int64, dst io.Writer, options *ApplyOptions) error {
+	return ApplyRangeContext(context.Background(), delta, deltaSize, dataSource, offset, length, dst, options)
+}
+
+// Like ApplyRangeWithOptions, but stops and returns the error of ctx if it
+// is cancelled
+func ApplyRangeContext(ctx context.Context, delta io.ReaderAt, deltaSize int64, dataSource DataSource, offset int64, length int64, dst io.Writer, options *ApplyOptions) error {
+	index, err := ReadDeltaIndex(delta, deltaSize)
+	if err != nil {
+		return err
+	}
+	a, err := newFrameApplier(delta, deltaSize, options)
+	if err != nil {
+		return err
+	}
+	a.progress = newProgressReporter(a.options, length, 0)
+	return a.applyRange(ctx, index, dataSource, a.options.newSourceVerifier(a.info), offset, length, dst)
+}
@@ -0,0 +1,94 @@
+package tar_patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestApplyRange(t *testing.T) {
+	var oldEntries, newEntries []tartest.Entry
+	for i := 0; i < 4; i++ {
+		data := tartest.RandomData(int64(i), 64*1024)
+		name := fmt.Sprintf("file%d", i)
+		oldEntries = append(oldEntries, tartest.File(name, data))
+		newEntries = append(newEntries, tartest.File(name, tartest.Modify(data, 1000)))
+	}
+	layers := tartest.BuildLayers(t, oldEntries, newEntries)
+	delta := makeTestDelta(t, layers.Old, layers.New, 16*1024)
+
+	index, err := ReadDeltaIndex(bytes.NewReader(delta), int64(len(delta)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Frames) < 4 {
+		t.Fatalf("Expected at least 4 frames, got %d", len(index.Frames))
+	}
+	if index.OutputSize != uint64(len(layers.New)) {
+		t.Fatalf("Wrong output size %d in index, expected %d", index.OutputSize, len(layers.New))
+	}
+	size := int64(len(layers.New))
+	frame1 := int64(index.Frames[1].OutputOffset)
+	frame3 := int64(index.Frames[3].OutputOffset)
+
+	for _, test := range []struct {
+		name   string
+		offset int64
+		length int64
+		err    bool
+	}{
+		{"all", 0, size, false},
+		{"inside a frame", frame1 + 100, 1000, false},
+		{"frame start", frame1, 1000, false},
+		{"across a frame boundary", frame1 - 500, 1000, false},
+		{"across several frames", frame1 - 10, frame3 - frame1 + 20, false},
+		{"end", size - 100, 100, false},
+		{"zero length", frame1, 0, false},
+		{"zero length at end", size, 0, false},
+		{"past the end", size - 100, 101, true},
+		{"after the end", size + 1, 10, true},
+		{"negative offset", -1, 10, true},
+		{"negative length", 0, -1, true},
+	} {
+		var out bytes.Buffer
+		err := ApplyRange(bytes.NewReader(delta), int64(len(delta)), NewMapDataSource(layers.OldFiles()), test.offset, test.length, &out)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(out.Bytes(), layers.New[test.offset:test.offset+test.length]) {
+			t.Errorf("%s: wrong output for %d+%d", test.name, test.offset, test.length)
+		}
+	}
+
+	corrupt := func(modify func(delta []byte)) []byte {
+		modified := append([]byte{}, delta...)
+		modify(modified)
+		return modified
+	}
+	for name, noIndex := range map[string][]byte{
+		"unframed":       makeTestDelta(t, layers.Old, layers.New, 0),
+		"footer magic":   corrupt(func(d []byte) { d[len(d)-1]++ }),
+		"footer size":    corrupt(func(d []byte) { d[len(d)-8]++ }),
+		"too large size": corrupt(func(d []byte) { d[len(d)-5] = 0xff }),
+		"frame magic":    corrupt(func(d []byte) { d[len(d)-int(binary.LittleEndian.Uint32(d[len(d)-8:]))]++ }),
+		"truncated":      delta[:len(delta)-1],
+	} {
+		if _, err := ReadDeltaIndex(bytes.NewReader(noIndex), int64(len(noIndex))); err != ErrNoDeltaIndex {
+			t.Errorf("%s: expected no index, got %v", name, err)
+		}
+		err := ApplyRange(bytes.NewReader(noIndex), int64(len(noIndex)), NewMapDataSource(layers.OldFiles()), 0, 10, &bytes.Buffer{})
+		if err != ErrNoDeltaIndex {
+			t.Errorf("%s: expected ApplyRange to fail without an index, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package tar_patch
+
+import (
+	"fmt"
+	"os"
+)
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, fmt.Errorf("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,122 @@
+package tar_patch
+
+import (
+	"fmt"
+
+	"github.com/containers/tar-diff/pkg/common"
+)
+
+const (
+	defaultMaxPathLength = 4096
+)
+
+type Limit string
+
+const (
+	LimitOutputSize    Limit = "output size"
+	LimitOpSize        Limit = "operation size"
+	LimitPathLength    Limit = "path length"
+	LimitOpenCount     Limit = "open count"
+	LimitDecoderMemory Limit = "decoder memory"
+	LimitOutputWindow  Limit = "output window"
+)
+
+// LimitError is returned when applying a delta would exceed one of the limits in ApplyOptions
+type LimitError struct {
+	Limit Limit
+	Value uint64
+	Max   uint64
+}
+
+func (e *LimitError) Error() string {
+	if e.Value == 0 {
+		return fmt.Sprintf("Delta exceeds %s limit of %d", e.Limit, e.Max)
+	}
+	return fmt.Sprintf("Delta exceeds %s limit (%d > %d)", e.Limit, e.Value, e.Max)
+}
+
+// ApplyOptions limits the resources used when applying an untrusted delta.
+// A limit of zero means unlimited.
+type ApplyOptions struct {
+	maxOutputSize    uint64
+	maxOpSize        uint64
+	maxPathLength    uint64
+	maxOpenCount     uint64
+	maxDecoderMemory uint64
+	maxOutputWindow  uint64
+	skipVerify       bool
+	fallbackFetcher  FallbackFetcher
+	progress         func(ProgressEvent)
+}
+
+// Maximum total size of the output
+func (o *ApplyOptions) SetMaxOutputSize(maxOutputSize uint64) {
+	o.maxOutputSize = maxOutputSize
+}
+
+// Maximum size of the output of a single operation. This also limits the
+// size of the source files of transform operations, which are read into
+// memory.
+func (o *ApplyOptions) SetMaxOpSize(maxOpSize uint64) {
+	o.maxOpSize = maxOpSize
+}
+
+// Maximum length of source file paths, this defaults to 4096
+func (o *ApplyOptions) SetMaxPathLength(maxPathLength uint64) {
+	o.maxPathLength = maxPathLength
+}
+
+// Maximum number of times source files are opened
+func (o *ApplyOptions) SetMaxOpenCount(maxOpenCount uint64) {
+	o.maxOpenCount = maxOpenCount
+}
+
+// Maximum memory used by the zstd decoder window
+func (o *ApplyOptions) SetMaxDecoderMemory(maxDecoderMemory uint64) {
+	o.maxDecoderMemory = maxDecoderMemory
+}
+
+// Maximum size of the earlier output kept for deltas that copy from it
+func (o *ApplyOptions) SetMaxOutputWindow(maxOutputWindow uint64) {
+	o.maxOutputWindow = maxOutputWindow
+}
+
+// Verify each source file against the digest recorded in the delta the
+// first time it's used, this defaults to true. Deltas created without
+// a source list are never verified.
+func (o *ApplyOptions) SetVerifySources(verifySources bool) {
+	o.skipVerify = !verifySources
+}
+
+// Fetch the output that needs a source file that is missing or fails
+// verification with fetcher, instead of failing
+func (o *ApplyOptions) SetFallbackFetcher(fetcher FallbackFetcher) {
+	o.fallbackFetcher = fetcher
+}
+
+// Called with the progress of applying the delta, see ProgressEvent. For
+// ApplyRange, only the output in the range is counted. Reader doesn't
+// report progress.
+func (o *ApplyOptions) SetProgress(progress func(ProgressEvent)) {
+	o.progress = progress
+}
+
+func NewApplyOptions() *ApplyOptions {
+	return &ApplyOptions{
+		maxPathLength: defaultMaxPathLength,
+	}
+}
+
+func checkLimit(limit Limit, value uint64, max uint64) error {
+	if max != 0 && value > max {
+		return &LimitError{Limit: limit, Value: value, Max: max}
+	}
+	return nil
+}
+
+func (o *ApplyOptions) newSourceVerifier(info *common.DeltaInfo) *sourceVerifier {
+	if o.skipVerify {
+		return nil
+	}
+	return newSourceVerifier(info)
+}
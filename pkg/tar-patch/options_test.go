@@ -0,0 +1,236 @@
+package tar_patch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/common"
+	"github.com/containers/tar-diff/pkg/tartest"
+	"github.com/klauspost/compress/zstd"
+)
+
+type testOp struct {
+	op   byte
+	size uint64
+	data []byte
+}
+
+// Builds a delta from raw ops, which need not be valid
+func makeRawDelta(t testing.TB, ops []testOp) []byte {
+	var raw bytes.Buffer
+	for _, o := range ops {
+		raw.WriteByte(o.op)
+		var buf [binary.MaxVarintLen64]byte
+		raw.Write(buf[:binary.PutUvarint(buf[:], o.size)])
+		raw.Write(o.data)
+	}
+
+	var delta bytes.Buffer
+	delta.Write(common.DeltaHeader[:])
+	encoder, err := zstd.NewWriter(&delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encoder.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return delta.Bytes()
+}
+
+func TestApplyLimits(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	open := testOp{common.DeltaOpOpen, 4, []byte("file")}
+	tests := []struct {
+		name    string
+		ops     []testOp
+		options func(o *ApplyOptions)
+		limit   Limit
+	}{
+		{"huge add", []testOp{open, {common.DeltaOpAddData, 1 << 62, nil}},
+			func(o *ApplyOptions) { o.SetMaxOpSize(1 << 20) }, LimitOpSize},
+		{"huge path", []testOp{{common.DeltaOpOpen, 1 << 62, nil}},
+			func(o *ApplyOptions) {}, LimitPathLength},
+		{"output size", []testOp{open, {common.DeltaOpCopy, 600, nil}, {common.DeltaOpSeek, 0, nil}, {common.DeltaOpCopy, 600, nil}},
+			func(o *ApplyOptions) { o.SetMaxOutputSize(1000) }, LimitOutputSize},
+		{"open count", []testOp{open, open, open},
+			func(o *ApplyOptions) { o.SetMaxOpenCount(2) }, LimitOpenCount},
+		{"huge transform", []testOp{open, {common.DeltaOpTransform, 1 << 40, []byte{common.TransformX86}}},
+			func(o *ApplyOptions) { o.SetMaxOpSize(1 << 20) }, LimitOpSize},
+		{"transform source", []testOp{open, {common.DeltaOpTransform, 100, []byte{common.TransformX86}}, {common.DeltaOpCopy, 100, nil}},
+			func(o *ApplyOptions) { o.SetMaxOpSize(512) }, LimitOpSize},
+	}
+
+	for _, test := range tests {
+		options := NewApplyOptions()
+		test.options(options)
+		delta := makeRawDelta(t, test.ops)
+		err := ApplyWithOptions(bytes.NewReader(delta), NewFilesystemDataSource(dir), ioutil.Discard, options)
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Errorf("%s: expected limit error, got %v", test.name, err)
+		} else if limitErr.Limit != test.limit {
+			t.Errorf("%s: expected %s limit, got %s", test.name, test.limit, limitErr.Limit)
+		}
+	}
+}
+
+func TestFramedApplyLimits(t *testing.T) {
+	var oldEntries, newEntries []tartest.Entry
+	for i := 0; i < 4; i++ {
+		data := tartest.RandomData(int64(i), 64*1024)
+		name := fmt.Sprintf("file%d", i)
+		oldEntries = append(oldEntries, tartest.File(name, data))
+		newEntries = append(newEntries, tartest.File(name, tartest.Modify(data, 1000)))
+	}
+	layers := tartest.BuildLayers(t, oldEntries, newEntries)
+	delta := makeTestDelta(t, layers.Old, layers.New, 16*1024)
+	size := int64(len(delta))
+
+	apply := map[string]func(options *ApplyOptions) error{
+		"range": func(options *ApplyOptions) error {
+			return ApplyRangeWithOptions(bytes.NewReader(delta), size, NewMapDataSource(layers.OldFiles()), 0, int64(len(layers.New)), ioutil.Discard, options)
+		},
+		"parallel": func(options *ApplyOptions) error {
+			newDataSource := func() (DataSource, error) {
+				return NewMapDataSource(layers.OldFiles()), nil
+			}
+			return ApplyParallelWithOptions(bytes.NewReader(delta), size, newDataSource, &bufferWriterAt{}, 2, options)
+		},
+		"reader": func(options *ApplyOptions) error {
+			r, err := NewReaderWithOptions(bytes.NewReader(delta), size, NewMapDataSource(layers.OldFiles()), options)
+			if err != nil {
+				return err
+			}
+			_, err = r.ReadAt(make([]byte, r.Size()), 0)
+			return err
+		},
+		"resumable": func(options *ApplyOptions) error {
+			return ApplyResumableWithOptions(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), ioutil.Discard, nil, nil, options)
+		},
+	}
+	limits := map[Limit]func(o *ApplyOptions){
+		LimitOpenCount:     func(o *ApplyOptions) { o.SetMaxOpenCount(2) },
+		LimitOpSize:        func(o *ApplyOptions) { o.SetMaxOpSize(1024) },
+		LimitDecoderMemory: func(o *ApplyOptions) { o.SetMaxDecoderMemory(1024) },
+	}
+
+	for name, apply := range apply {
+		if err := apply(nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for limit, setLimit := range limits {
+			options := NewApplyOptions()
+			setLimit(options)
+			err := apply(options)
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Limit != limit {
+				t.Errorf("%s: expected %s limit error, got %v", name, limit, err)
+			}
+		}
+	}
+}
+
+func TestApplyAddDataChunks(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	source := make([]byte, 3*addDataChunkSize+17)
+	for i := range source {
+		source[i] = byte(i)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), source, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	add := make([]byte, len(source))
+	expected := make([]byte, len(source))
+	for i := range add {
+		add[i] = byte(i * 7)
+		expected[i] = add[i] + source[i]
+	}
+	delta := makeRawDelta(t, []testOp{
+		{common.DeltaOpOpen, 4, []byte("file")},
+		{common.DeltaOpAddData, uint64(len(add)), add},
+	})
+
+	var out bytes.Buffer
+	if err := Apply(bytes.NewReader(delta), NewFilesystemDataSource(dir), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Error("wrong output")
+	}
+}
+
+func TestMalformedDeltaInfo(t *testing.T) {
+	putUvarint := func(b *bytes.Buffer, v uint64) {
+		var buf [binary.MaxVarintLen64]byte
+		b.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+	putString := func(b *bytes.Buffer, s string) {
+		putUvarint(b, uint64(len(s)))
+		b.WriteString(s)
+	}
+	tooLarge := uint64(math.MaxInt64) + 1
+
+	var tarSection, sourcesSection, outputSection, compressionSection bytes.Buffer
+	putUvarint(&tarSection, tooLarge)
+	putString(&tarSection, "sha256:1234")
+	putUvarint(&sourcesSection, 1)
+	putString(&sourcesSection, "file")
+	putUvarint(&sourcesSection, tooLarge)
+	putString(&sourcesSection, "")
+	putUvarint(&outputSection, tooLarge)
+	putString(&compressionSection, "gzip")
+	compressionSection.WriteByte(12) // Level 6, as a varint
+	// Empty block size, name, comment and extra
+	for i := 0; i < 4; i++ {
+		putUvarint(&compressionSection, 0)
+	}
+	putUvarint(&compressionSection, 0) // Modification time
+	putUvarint(&compressionSection, 3) // OS
+	putUvarint(&compressionSection, tooLarge)
+	putString(&compressionSection, "sha256:1234")
+
+	for tag, section := range map[uint64]*bytes.Buffer{
+		1: &compressionSection,
+		2: &tarSection,
+		3: &sourcesSection,
+		4: &outputSection,
+	} {
+		var info bytes.Buffer
+		putUvarint(&info, tag)
+		putString(&info, section.String())
+
+		var delta bytes.Buffer
+		delta.Write(common.DeltaHeader[:])
+		if err := common.WriteSkippableFrame(&delta, common.DeltaInfoFrameMagic, info.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		delta.Write(makeRawDelta(t, nil)[len(common.DeltaHeader):])
+
+		_, err := ReadDeltaInfo(bytes.NewReader(delta.Bytes()))
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("Section %d: expected a too large value error, got %v", tag, err)
+		}
+		err = Apply(bytes.NewReader(delta.Bytes()), NewMapDataSource(nil), ioutil.Discard)
+		if err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("Section %d: expected apply to fail, got %v", tag, err)
+		}
+	}
+}
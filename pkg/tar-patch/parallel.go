@@ -0,0 +1,164 @@
+package tar_patch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	parallelOutputBufferSize = 1024 * 1024
+)
+
+// Writes sequentially to an io.WriterAt, starting at offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// Like Apply, but for framed deltas the frames are decoded and applied on
+// several goroutines. Each goroutine uses its own DataSource, created by
+// newDataSource, and writes its part of the output at the right offset in
+// dst. If workers is <= 0, GOMAXPROCS goroutines are used. Deltas without a
+// frame index are applied serially. When the delta records the digest of
+// the new tarfile, the output is read back from dst in order to check it,
+// so dst must then also implement io.ReaderAt.
+func ApplyParallel(delta io.ReaderAt, deltaSize int64, newDataSource func() (DataSource, error), dst io.WriterAt, workers int) error {
+	return ApplyParallelWithOptions(delta, deltaSize, newDataSource, dst, workers, nil)
+}
+
+// Like ApplyParallel, but with limits on the resources used, see
+// ApplyWithOptions. The limits apply to all the goroutines together,
+// except for the decoder memory, which is per goroutine.
+func ApplyParallelWithOptions(delta io.ReaderAt, deltaSize int64, newDataSource func() (DataSource, error), dst io.WriterAt, workers int, options *ApplyOptions) error {
+	return ApplyParallelContext(context.Background(), delta, deltaSize, newDataSource, dst, workers, options)
+}
+
+// Like ApplyParallelWithOptions, but stops all the goroutines and returns
+// the error of ctx if it is cancelled
+func ApplyParallelContext(ctx context.Context, delta io.ReaderAt, deltaSize int64, newDataSource func() (DataSource, error), dst io.WriterAt, workers int, options *ApplyOptions) error {
+	index, err := ReadDeltaIndex(delta, deltaSize)
+	if err == ErrNoDeltaIndex {
+		dataSource, err := newDataSource()
+		if err != nil {
+			return err
+		}
+		defer dataSource.Close()
+		return ApplyContext(ctx, io.NewSectionReader(delta, 0, deltaSize), dataSource, &offsetWriter{w: dst}, options)
+	}
+	if err != nil {
+		return err
+	}
+	a, err := newFrameApplier(delta, deltaSize, options)
+	if err != nil {
+		return err
+	}
+	a.progress = newProgressReporter(a.options, int64(index.OutputSize), 0)
+	output, _ := dst.(io.ReaderAt)
+	if a.info.TarDigest != "" && output == nil {
+		return fmt.Errorf("Can't verify the output digest, the destination doesn't implement io.ReaderAt")
+	}
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(index.Frames) {
+		workers = len(index.Frames)
+	}
+
+	jobs := make(chan int)
+	done := make(chan struct{})
+	var errOnce sync.Once
+	var firstErr error
+	setErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+
+	worker := func() error {
+		dataSource, err := newDataSource()
+		if err != nil {
+			return err
+		}
+		defer dataSource.Close()
+		// The verifier isn't safe to share, so each goroutine checks the sources it uses
+		verifier := a.options.newSourceVerifier(a.info)
+
+		decoder, err := newOpDecoder(a.options, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer decoder.Close()
+
+		for i := range jobs {
+			frame := &index.Frames[i]
+			end := index.OutputSize
+			if i+1 < len(index.Frames) {
+				end = index.Frames[i+1].OutputOffset
+			}
+
+			out := bufio.NewWriterSize(&offsetWriter{w: dst, offset: int64(frame.OutputOffset)}, parallelOutputBufferSize)
+			if err := a.applyFrame(ctx, frame, decoder, dataSource, verifier, int64(frame.OutputOffset), int64(end), out); err != nil {
+				return err
+			}
+			if err := out.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := worker(); err != nil {
+				setErr(err)
+				// Keep draining so the producer doesn't block
+				for range jobs {
+				}
+			}
+		}()
+	}
+
+queueJobs:
+	for i := range index.Frames {
+		select {
+		case jobs <- i:
+		case <-done:
+			break queueJobs
+		case <-ctx.Done():
+			setErr(ctx.Err())
+			break queueJobs
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if a.info.TarDigest == "" {
+		return nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(output, 0, int64(index.OutputSize))); err != nil {
+		return err
+	}
+	return checkTarDigest(a.info, h)
+}
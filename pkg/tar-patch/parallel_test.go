@@ -0,0 +1,142 @@
+package tar_patch
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+// Creates layers with files of the given size, where the new files have
+// small changes spread out over the entire file, and writes the old files
+// to dir
+func makeTestData(t testing.TB, dir string, nFiles int, fileSize int) *tartest.Layers {
+	var oldEntries, newEntries []tartest.Entry
+	for i := 0; i < nFiles; i++ {
+		data := tartest.RandomData(int64(42+i), fileSize)
+		name := "dir/" + string(rune('a'+i)) + ".bin"
+		oldEntries = append(oldEntries, tartest.File(name, data))
+		newEntries = append(newEntries, tartest.File(name, tartest.Modify(data, 1000)))
+	}
+	layers := tartest.BuildLayers(t, oldEntries, newEntries)
+	layers.WriteOldFiles(t, dir)
+	return layers
+}
+
+type bufferWriterAt struct {
+	lock sync.Mutex
+	buf  []byte
+}
+
+func (b *bufferWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if need := int(off) + len(p); need > len(b.buf) {
+		b.buf = append(b.buf, make([]byte, need-len(b.buf))...)
+	}
+	return copy(b.buf[off:], p), nil
+}
+
+func (b *bufferWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if off >= int64(len(b.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func makeTempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "tar-patch-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestApplyParallel(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	layers := makeTestData(t, dir, 4, 256*1024)
+	newDataSource := func() (DataSource, error) {
+		return NewFilesystemDataSource(dir), nil
+	}
+
+	for _, frameSize := range []int64{0, 64 * 1024, 1024 * 1024} {
+		delta := makeTestDelta(t, layers.Old, layers.New, frameSize)
+		for _, workers := range []int{1, 3, 0} {
+			out := &bufferWriterAt{}
+			if err := ApplyParallel(bytes.NewReader(delta), int64(len(delta)), newDataSource, out, workers); err != nil {
+				t.Fatalf("frame size %d, %d workers: %v", frameSize, workers, err)
+			}
+			if !bytes.Equal(out.buf, layers.New) {
+				t.Errorf("frame size %d, %d workers: wrong output", frameSize, workers)
+			}
+		}
+	}
+
+	// With the source checks off, a modified old file is only caught by the output digest
+	if err := ioutil.WriteFile(filepath.Join(dir, "dir/b.bin"), tartest.RandomData(1, 256*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := NewApplyOptions()
+	options.SetVerifySources(false)
+	delta := makeTestDelta(t, layers.Old, layers.New, 64*1024)
+	err := ApplyParallelWithOptions(bytes.NewReader(delta), int64(len(delta)), newDataSource, &bufferWriterAt{}, 3, options)
+	if err == nil || !strings.Contains(err.Error(), "Reconstructed tarfile doesn't match") {
+		t.Fatalf("Expected digest mismatch, got %v", err)
+	}
+	err = ApplyParallel(bytes.NewReader(delta), int64(len(delta)), newDataSource, &struct{ io.WriterAt }{&bufferWriterAt{}}, 3)
+	if err == nil || !strings.Contains(err.Error(), "io.ReaderAt") {
+		t.Fatalf("Expected error for a destination without ReadAt, got %v", err)
+	}
+}
+
+func benchmarkApply(b *testing.B, parallel bool) {
+	dir := makeTempDir(b)
+	defer os.RemoveAll(dir)
+	layers := makeTestData(b, dir, 8, 4*1024*1024)
+	delta := makeTestDelta(b, layers.Old, layers.New, 1024*1024)
+	newDataSource := func() (DataSource, error) {
+		return NewFilesystemDataSource(dir), nil
+	}
+
+	out, err := ioutil.TempFile(dir, "out")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	b.SetBytes(int64(len(layers.New)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if parallel {
+			err = ApplyParallel(bytes.NewReader(delta), int64(len(delta)), newDataSource, out, 0)
+		} else {
+			dataSource, _ := newDataSource()
+			err = Apply(bytes.NewReader(delta), dataSource, &offsetWriter{w: out})
+			dataSource.Close()
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkApplySerial(b *testing.B) {
+	benchmarkApply(b, false)
+}
+
+func BenchmarkApplyParallel(b *testing.B) {
+	benchmarkApply(b, true)
+}
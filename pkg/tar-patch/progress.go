@@ -0,0 +1,50 @@
+package tar_patch
+
+import (
+	"sync"
+)
+
+// How often progress is reported, in bytes of output
+const progressInterval = 1024 * 1024
+
+// ProgressEvent is passed to the progress callback set with
+// ApplyOptions.SetProgress every megabyte of output, after each frame of
+// framed deltas, and when all the output is written
+type ProgressEvent struct {
+	OutputBytes int64 // Output written so far
+	Ops         int64 // Delta operations applied so far
+	TotalBytes  int64 // Size of the output if known, or 0
+}
+
+// Collects the progress of the patchers applying a delta, which run on
+// several goroutines for ApplyParallel. The callback is called with the
+// lock held, so never concurrently.
+type progressReporter struct {
+	lock     sync.Mutex
+	callback func(ProgressEvent)
+	event    ProgressEvent
+}
+
+// Returns nil if there is no progress callback in options. When resuming,
+// done is the output written before.
+func newProgressReporter(options *ApplyOptions, total int64, done int64) *progressReporter {
+	if options.progress == nil {
+		return nil
+	}
+	return &progressReporter{
+		callback: options.progress,
+		event:    ProgressEvent{OutputBytes: done, TotalBytes: total},
+	}
+}
+
+// Adds the output and ops applied since the last call, and reports the progress
+func (r *progressReporter) add(output int64, ops int64) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.event.OutputBytes += output
+	r.event.Ops += ops
+	r.callback(r.event)
+}
@@ -0,0 +1,109 @@
+package tar_patch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestApplyProgress(t *testing.T) {
+	big := tartest.RandomData(1, 3*1024*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("big", big),
+		tartest.File("small", []byte("old\n")),
+	}, []tartest.Entry{
+		tartest.File("big", tartest.Modify(big, 100000)),
+		tartest.File("small", []byte("new\n")),
+	})
+	delta := diffAndApply(t, layers, nil)
+
+	var events []ProgressEvent
+	options := NewApplyOptions()
+	options.SetProgress(func(e ProgressEvent) {
+		events = append(events, e)
+	})
+	var out bytes.Buffer
+	if err := ApplyWithOptions(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &out, options); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), layers.New) {
+		t.Errorf("Wrong output")
+	}
+	if len(events) < 2 {
+		t.Fatalf("Expected more events, got %d", len(events))
+	}
+	end := events[len(events)-1]
+	if end.OutputBytes != int64(len(layers.New)) || end.TotalBytes != end.OutputBytes || end.Ops == 0 {
+		t.Errorf("Wrong last event %v", end)
+	}
+}
+
+func TestFramedProgress(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	layers := makeTestData(t, dir, 4, 256*1024)
+	delta := makeTestDelta(t, layers.Old, layers.New, 64*1024)
+	size := int64(len(layers.New))
+	newDataSource := func() (DataSource, error) {
+		return NewFilesystemDataSource(dir), nil
+	}
+
+	var resumeAt *Checkpoint
+	if err := ApplyResumable(bytes.NewReader(delta), NewFilesystemDataSource(dir), ioutil.Discard, nil, func(c *Checkpoint) error {
+		if resumeAt == nil && c.OutputOffset > size/2 {
+			resumeAt = c
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		apply func(options *ApplyOptions) error
+		start int64 // First OutputBytes reported
+		total int64
+	}{
+		{"parallel", func(options *ApplyOptions) error {
+			return ApplyParallelWithOptions(bytes.NewReader(delta), int64(len(delta)), newDataSource, &bufferWriterAt{}, 3, options)
+		}, 0, size},
+		{"range", func(options *ApplyOptions) error {
+			return ApplyRangeWithOptions(bytes.NewReader(delta), int64(len(delta)), NewFilesystemDataSource(dir), 1000, size/2, ioutil.Discard, options)
+		}, 0, size / 2},
+		{"resumable", func(options *ApplyOptions) error {
+			return ApplyResumableWithOptions(bytes.NewReader(delta), NewFilesystemDataSource(dir), ioutil.Discard, nil, nil, options)
+		}, 0, size},
+		{"resumed", func(options *ApplyOptions) error {
+			return ApplyResumableWithOptions(bytes.NewReader(delta), NewFilesystemDataSource(dir), ioutil.Discard, resumeAt, nil, options)
+		}, resumeAt.OutputOffset, size},
+	}
+	for _, test := range tests {
+		var lock sync.Mutex
+		var events []ProgressEvent
+		options := NewApplyOptions()
+		options.SetProgress(func(e ProgressEvent) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, e)
+		})
+		if err := test.apply(options); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(events) < 2 {
+			t.Fatalf("%s: expected more events, got %d", test.name, len(events))
+		}
+		for i, e := range events {
+			if e.TotalBytes != test.total || e.OutputBytes < test.start || (i > 0 && e.OutputBytes < events[i-1].OutputBytes) {
+				t.Fatalf("%s: wrong event %v", test.name, e)
+			}
+		}
+		end := events[len(events)-1]
+		if end.OutputBytes != test.total || end.Ops == 0 {
+			t.Errorf("%s: wrong last event %v", test.name, end)
+		}
+	}
+}
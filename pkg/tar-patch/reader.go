@@ -0,0 +1,171 @@
+package tar_patch
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containers/tar-diff/pkg/common"
+)
+
+// Reader gives random access to the tarfile reconstructed from a framed
+// delta, decoding only the frames needed for each read.
+type Reader struct {
+	applier    *frameApplier
+	index      *common.DeltaIndex
+	tocByName  map[string]*common.TOCEntry
+	lock       sync.Mutex // Protects the fields below
+	dataSource DataSource
+	verifier   *sourceVerifier
+	// The output of the last decoded frame, so that small sequential reads
+	// don't decode the same frame again
+	cachedFrame int
+	cache       []byte
+}
+
+func NewReader(delta io.ReaderAt, deltaSize int64, dataSource DataSource) (*Reader, error) {
+	return NewReaderWithOptions(delta, deltaSize, dataSource, nil)
+}
+
+// Like NewReader, but with limits on the resources used, see ApplyWithOptions
+func NewReaderWithOptions(delta io.ReaderAt, deltaSize int64, dataSource DataSource, options *ApplyOptions) (*Reader, error) {
+	index, err := ReadDeltaIndex(delta, deltaSize)
+	if err != nil {
+		return nil, err
+	}
+	applier, err := newFrameApplier(delta, deltaSize, options)
+	if err != nil {
+		return nil, err
+	}
+
+	tocByName := make(map[string]*common.TOCEntry)
+	for i := range index.TOC {
+		e := &index.TOC[i]
+		// Later entries override earlier ones, like when extracting
+		tocByName[cleanPath(e.Name)] = e
+	}
+
+	return &Reader{
+		applier:     applier,
+		index:       index,
+		tocByName:   tocByName,
+		dataSource:  dataSource,
+		verifier:    applier.options.newSourceVerifier(applier.info),
+		cachedFrame: -1,
+	}, nil
+}
+
+// Returns the whole output of frame i, decoding it unless it is cached
+func (r *Reader) frameOutput(ctx context.Context, i int) ([]byte, error) {
+	if i == r.cachedFrame {
+		return r.cache, nil
+	}
+	r.cachedFrame = -1
+
+	frame := &r.index.Frames[i]
+	end := r.index.OutputSize
+	if i+1 < len(r.index.Frames) {
+		end = r.index.Frames[i+1].OutputOffset
+	}
+	if end < frame.OutputOffset {
+		return nil, fmt.Errorf("Invalid delta index")
+	}
+
+	decoder, err := newOpDecoder(r.applier.options)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	out := bytes.NewBuffer(r.cache[:0])
+	if err := r.applier.applyFrame(ctx, frame, decoder, r.dataSource, r.verifier, int64(frame.OutputOffset), int64(end), out); err != nil {
+		return nil, err
+	}
+	if uint64(out.Len()) != end-frame.OutputOffset {
+		return nil, io.ErrUnexpectedEOF
+	}
+	r.cache = out.Bytes()
+	r.cachedFrame = i
+	return r.cache, nil
+}
+
+// Size of the reconstructed tarfile
+func (r *Reader) Size() int64 {
+	return int64(r.index.OutputSize)
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	return r.ReadAtContext(context.Background(), p, off)
+}
+
+// Like ReadAt, but stops and returns the error of ctx if it is cancelled
+func (r *Reader) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	size := r.Size()
+	if off < 0 {
+		return 0, fmt.Errorf("Negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	length := int64(len(p))
+	if length > size-off {
+		length = size - off
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	i := findFrame(r.index, uint64(off))
+	if i < 0 {
+		return 0, fmt.Errorf("Invalid delta index")
+	}
+	n := 0
+	for ; n < int(length); i++ {
+		if i >= len(r.index.Frames) {
+			return n, io.ErrUnexpectedEOF
+		}
+		output, err := r.frameOutput(ctx, i)
+		if err != nil {
+			return n, err
+		}
+		pos := off + int64(n) - int64(r.index.Frames[i].OutputOffset)
+		if pos < int64(len(output)) {
+			n += copy(p[n:length], output[pos:])
+		}
+	}
+	if length < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Returns all the entries in the reconstructed tarfile, in order.
+// This is empty if the delta was created without a table of contents.
+func (r *Reader) TOC() []common.TOCEntry {
+	return r.index.TOC
+}
+
+// Returns the entry for the file with the given path, or nil if there is none
+func (r *Reader) Lookup(name string) *common.TOCEntry {
+	return r.tocByName[cleanPath(name)]
+}
+
+// Returns a reader for the content of a regular file in the reconstructed
+// tarfile. Hardlinks are resolved to the file they point to.
+func (r *Reader) OpenFile(name string) (*io.SectionReader, error) {
+	entry := r.Lookup(name)
+	for i := 0; entry != nil && entry.Typeflag == tar.TypeLink && i < 32; i++ {
+		entry = r.Lookup(entry.Linkname)
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("No such file %s in tarfile", name)
+	}
+	if entry.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	return io.NewSectionReader(r, entry.Offset, entry.Size), nil
+}
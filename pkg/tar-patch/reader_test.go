@@ -0,0 +1,105 @@
+package tar_patch
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	layers := makeTestData(t, dir, 4, 256*1024)
+	delta := makeTestDelta(t, layers.Old, layers.New, 64*1024)
+
+	r, err := NewReader(bytes.NewReader(delta), int64(len(delta)), NewFilesystemDataSource(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Size() != int64(len(layers.New)) {
+		t.Fatalf("Wrong size %d, expected %d", r.Size(), len(layers.New))
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		off := rnd.Int63n(r.Size())
+		buf := make([]byte, rnd.Intn(200*1024))
+		n, err := r.ReadAt(buf, off)
+		expected := layers.New[off:]
+		if len(expected) > len(buf) {
+			expected = expected[:len(buf)]
+		}
+		if n != len(expected) || !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("Wrong data reading %d bytes at %d", len(buf), off)
+		}
+		if n < len(buf) && err != io.EOF {
+			t.Fatalf("Expected EOF for short read, got %v", err)
+		}
+	}
+
+	// Small sequential reads, which mostly hit the cached frame
+	var out bytes.Buffer
+	buf := make([]byte, 1000)
+	if _, err := io.CopyBuffer(&out, struct{ io.Reader }{io.NewSectionReader(r, 0, r.Size())}, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), layers.New) {
+		t.Fatalf("Wrong data for sequential reads")
+	}
+
+	if len(r.TOC()) != 4 {
+		t.Fatalf("Expected 4 TOC entries, got %d", len(r.TOC()))
+	}
+	f, err := r.OpenFile("dir/b.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(bytes.NewReader(layers.New))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name == "dir/b.bin" {
+			break
+		}
+	}
+	expected, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("Unexpected content for dir/b.bin")
+	}
+	if _, err := r.OpenFile("dir/missing"); err == nil {
+		t.Fatalf("Expected error opening missing file")
+	}
+}
+
+func BenchmarkReaderSmallReads(b *testing.B) {
+	dir := makeTempDir(b)
+	defer os.RemoveAll(dir)
+	layers := makeTestData(b, dir, 4, 1024*1024)
+	delta := makeTestDelta(b, layers.Old, layers.New, 1024*1024)
+
+	r, err := NewReader(bytes.NewReader(delta), int64(len(delta)), NewFilesystemDataSource(dir))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	b.SetBytes(int64(len(layers.New)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{io.NewSectionReader(r, 0, r.Size())}, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package tar_patch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containers/tar-diff/pkg/common"
+)
+
+// Checkpoint is the state needed to continue applying a framed delta at the
+// start of a frame.
+type Checkpoint struct {
+	DeltaSize       int64  // Size of the delta file
+	DeltaInfoDigest string // Digest of the delta info, with DeltaSize this identifies the delta
+
+	DeltaOffset    int64  // Offset of the next frame in the delta file
+	OutputOffset   int64  // Number of bytes written to the output
+	SourceFile     string // Current source file at the start of the frame
+	SourceDigest   string // Or its digest, if the delta references sources by digest
+	SourcePosition int64  // Position in the source file at the start of the frame
+	HashState      []byte // Marshalled sha256 state for the output so far
+}
+
+// Checks that the checkpoint was saved at the start of frame
+func (c *Checkpoint) checkFrame(frame *common.FrameInfo) error {
+	if c.OutputOffset != int64(frame.OutputOffset) || c.SourceFile != frame.SourceFile ||
+		c.SourceDigest != frame.SourceDigest || c.SourcePosition != int64(frame.SourcePosition) {
+		return fmt.Errorf("Checkpoint doesn't match the delta frame at offset %d", c.DeltaOffset)
+	}
+	return nil
+}
+
+// CheckpointFunc is called at each frame boundary. Any output written before
+// the call must be made persistent before the checkpoint is.
+type CheckpointFunc func(checkpoint *Checkpoint) error
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func LoadCheckpoint(filename string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("Invalid checkpoint file %s: %v", filename, err)
+	}
+	return checkpoint, nil
+}
+
+// Atomically replaces filename with the new checkpoint
+func SaveCheckpoint(filename string, checkpoint *Checkpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+
+	tmpfile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmpfile.Write(data)
+	if err == nil {
+		err = tmpfile.Sync()
+	}
+	closeErr := tmpfile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpfile.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmpfile.Name())
+	}
+	return err
+}
+
+// Like Apply, but for framed deltas checkpoint is called at the start of
+// each frame, and if resume is set, applying continues from that
+// checkpoint, which must be from the same delta. When resuming, dst must already contain exactly
+// resume.OutputOffset bytes of earlier output, and new output is
+// appended to it.
+//
+// The output is verified against the digest of the new tarfile if it is
+// recorded in the delta. Deltas that are not framed are applied without
+// checkpoints, and can't be resumed.
+func ApplyResumable(delta io.ReadSeeker, dataSource DataSource, dst io.Writer, resume *Checkpoint, checkpoint CheckpointFunc) error {
+	return ApplyResumableWithOptions(delta, dataSource, dst, resume, checkpoint, nil)
+}
+
+// Like ApplyResumable, but with limits on the resources used, see
+// ApplyWithOptions. When resuming, the limits only count what is applied
+// after the checkpoint, except for the output size.
+func ApplyResumableWithOptions(delta io.ReadSeeker, dataSource DataSource, dst io.Writer, resume *Checkpoint, checkpoint CheckpointFunc, options *ApplyOptions) error {
+	return ApplyResumableContext(context.Background(), delta, dataSource, dst, resume, checkpoint, options)
+}
+
+// Like ApplyResumableWithOptions, but stops and returns the error of ctx if
+// it is cancelled. The output can then be resumed from the last checkpoint.
+func ApplyResumableContext(ctx context.Context, delta io.ReadSeeker, dataSource DataSource, dst io.Writer, resume *Checkpoint, checkpoint CheckpointFunc, options *ApplyOptions) error {
+	if options == nil {
+		options = NewApplyOptions()
+	}
+	deltaSize, err := delta.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := delta.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	counter := &countingReader{r: delta}
+	r := bufio.NewReader(counter)
+	info, err := readDeltaHeader(r)
+	if err != nil {
+		return err
+	}
+	infoDigest := fmt.Sprintf("sha256:%x", sha256.Sum256(info.Marshal()))
+
+	verifier := options.newSourceVerifier(info)
+
+	h := sha256.New()
+	output := &countingWriter{w: io.MultiWriter(dst, h)}
+
+	if resume != nil {
+		if resume.DeltaSize != deltaSize || resume.DeltaInfoDigest != infoDigest {
+			return fmt.Errorf("Checkpoint was saved for a different delta")
+		}
+		if _, err := delta.Seek(resume.DeltaOffset, io.SeekStart); err != nil {
+			return err
+		}
+		counter.n = resume.DeltaOffset
+		r.Reset(counter)
+
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(resume.HashState); err != nil {
+			return fmt.Errorf("Invalid checkpoint hash state: %v", err)
+		}
+		output.n = resume.OutputOffset
+	}
+
+	decoder, err := newOpDecoder(options)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	progress := newProgressReporter(options, info.TarSize, output.n)
+	openCount := uint64(0)
+	for first := true; true; first = false {
+		deltaOffset := counter.n - int64(r.Buffered())
+
+		magicBytes, err := r.Peek(4)
+		if err != nil {
+			if err == io.EOF && len(magicBytes) == 0 {
+				break
+			}
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(magicBytes)
+
+		if !common.IsSkippableFrameMagic(magic) {
+			// Not a framed delta, so just apply it all
+			if !first || resume != nil {
+				return fmt.Errorf("Delta is not framed, can't resume")
+			}
+			if err := applyOps(ctx, r, dataSource, output, options, info, verifier); err != nil {
+				return err
+			}
+			break
+		}
+
+		if _, err := r.Discard(4); err != nil {
+			return err
+		}
+		data, err := common.ReadSkippableFrameData(r)
+		if err != nil {
+			return err
+		}
+		if magic != common.DeltaSyncFrameMagic {
+			if first && resume != nil {
+				return fmt.Errorf("Checkpoint doesn't point to a delta frame")
+			}
+			continue // Some other metadata, skip it
+		}
+
+		frame, err := common.UnmarshalFrameInfo(data)
+		if err != nil {
+			return err
+		}
+		if first && resume != nil {
+			if err := resume.checkFrame(frame); err != nil {
+				return err
+			}
+		}
+		if frame.OutputOffset != uint64(output.n) {
+			return fmt.Errorf("Unexpected output offset %d in delta frame, expected %d", frame.OutputOffset, output.n)
+		}
+
+		if first && resume != nil {
+			// Restore the source state from the frame, everything else is fresh
+			if err := openFrameSource(dataSource, frame, verifier); err != nil {
+				return err
+			}
+		} else if checkpoint != nil {
+			hashState, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+			if err != nil {
+				return err
+			}
+			err = checkpoint(&Checkpoint{
+				DeltaSize:       deltaSize,
+				DeltaInfoDigest: infoDigest,
+				DeltaOffset:     deltaOffset,
+				OutputOffset:    output.n,
+				SourceFile:      frame.SourceFile,
+				SourceDigest:    frame.SourceDigest,
+				SourcePosition:  int64(frame.SourcePosition),
+				HashState:       hashState,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		frameData := io.LimitReader(r, int64(frame.Size))
+		if err := decoder.Reset(frameData); err != nil {
+			return decoderError(err, options)
+		}
+		p := newPatcher(dataSource, output, options)
+		p.ctx = ctx
+		p.openCount = &openCount
+		p.verifier = verifier
+		p.outputPos = int64(frame.OutputOffset)
+		// Copies from output never reach back before the start of the frame
+		if err := p.setOutputWindow(info.OutputWindow); err != nil {
+			return err
+		}
+		p.setProgress(progress, p.outputPos)
+		if err := p.execute(bufio.NewReader(decoder)); err != nil {
+			return err
+		}
+		p.updateProgress()
+		// Make sure we're at the end of the frame
+		if _, err := io.Copy(ioutil.Discard, frameData); err != nil {
+			return err
+		}
+	}
+
+	return checkTarDigest(info, h)
+}
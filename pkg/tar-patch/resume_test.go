@@ -0,0 +1,152 @@
+package tar_patch
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+var errInterrupted = errors.New("Interrupted")
+
+// Interrupts applying the delta after each of its checkpoints in turn, and
+// checks that resuming from the saved checkpoint recreates the new tarfile
+func checkResume(t *testing.T, delta []byte, layers *tartest.Layers) {
+	t.Helper()
+	dir := makeTempDir(t)
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoint")
+
+	for stopAt := 1; ; stopAt++ {
+		// Save one checkpoint, and fail at the next one, after more output
+		// was written
+		var out bytes.Buffer
+		n := 0
+		err := ApplyResumable(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &out, nil, func(c *Checkpoint) error {
+			n++
+			if n == stopAt {
+				return SaveCheckpoint(checkpointFile, c)
+			}
+			if n > stopAt {
+				return errInterrupted
+			}
+			return nil
+		})
+		if err == nil {
+			if stopAt == 1 {
+				t.Fatalf("Expected several frames, got %d", n)
+			}
+			break
+		}
+		if err != errInterrupted {
+			t.Fatal(err)
+		}
+
+		checkpoint, err := LoadCheckpoint(checkpointFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkpoint.OutputOffset >= int64(out.Len()) {
+			t.Fatalf("Checkpoint %d at %d, expected output after it", stopAt, checkpoint.OutputOffset)
+		}
+		out.Truncate(int(checkpoint.OutputOffset))
+		if err := ApplyResumable(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &out, checkpoint, nil); err != nil {
+			t.Fatalf("Resuming from checkpoint %d: %v", stopAt, err)
+		}
+		if !bytes.Equal(out.Bytes(), layers.New) {
+			t.Fatalf("Wrong output resuming from checkpoint %d", stopAt)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	data := tartest.RandomData(1, 256*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("dir/a", data),
+		tartest.File("dir/b", tartest.RandomData(2, 128*1024)),
+	}, []tartest.Entry{
+		tartest.File("dir/b", tartest.Modify(tartest.RandomData(2, 128*1024), 2000)),
+		tartest.File("dir/new", []byte("new file")),
+		tartest.File("dir/a", tartest.Modify(data, 3000)),
+	})
+	// Frames start in the middle of the source files
+	delta := makeTestDelta(t, layers.Old, layers.New, 32*1024)
+	checkResume(t, delta, layers)
+
+	// The hash state of the checkpoint is needed to verify the output
+	checkpoint := &Checkpoint{}
+	err := ApplyResumable(bytes.NewReader(delta), NewMapDataSource(layers.OldFiles()), &bytes.Buffer{}, nil, func(c *Checkpoint) error {
+		if c.OutputOffset > 0 && checkpoint.OutputOffset == 0 {
+			*checkpoint = *c
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A delta for a different new tarfile
+	otherNew, err := tartest.Build([]tartest.Entry{
+		tartest.File("dir/b", tartest.Modify(tartest.RandomData(2, 128*1024), 2000)),
+		tartest.File("dir/new", []byte("NEW FILE")),
+		tartest.File("dir/a", tartest.Modify(data, 3000)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDelta := makeTestDelta(t, layers.Old, otherNew, 32*1024)
+
+	for name, test := range map[string]struct {
+		delta  []byte
+		modify func(c *Checkpoint)
+		err    string
+	}{
+		"hash state":      {delta, func(c *Checkpoint) { c.HashState = []byte("invalid") }, "hash state"},
+		"other delta":     {otherDelta, func(c *Checkpoint) {}, "different delta"},
+		"not framed":      {makeTestDelta(t, layers.Old, layers.New, 0), func(c *Checkpoint) {}, "different delta"},
+		"source position": {delta, func(c *Checkpoint) { c.SourcePosition++ }, "doesn't match the delta frame"},
+		"source file":     {delta, func(c *Checkpoint) { c.SourceFile = "dir/other" }, "doesn't match the delta frame"},
+		"output offset":   {delta, func(c *Checkpoint) { c.OutputOffset++ }, "doesn't match the delta frame"},
+		"not at a frame":  {delta, func(c *Checkpoint) { c.DeltaOffset++ }, ""},
+		"delta size":      {delta, func(c *Checkpoint) { c.DeltaSize++ }, "different delta"},
+		"delta info":      {delta, func(c *Checkpoint) { c.DeltaInfoDigest = "sha256:1234" }, "different delta"},
+	} {
+		modified := *checkpoint
+		test.modify(&modified)
+		var out bytes.Buffer
+		out.Write(layers.New[:modified.OutputOffset])
+		err := ApplyResumable(bytes.NewReader(test.delta), NewMapDataSource(layers.OldFiles()), &out, &modified, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected %q error, got %v", name, test.err, err)
+		}
+	}
+}
+
+func TestResumeDedup(t *testing.T) {
+	lib := tartest.RandomData(1, 8*1024)
+	// The copies of lib are in the second frame
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("README", []byte("old\n")),
+	}, []tartest.Entry{
+		tartest.File("data", tartest.RandomData(2, 80*1024)),
+		tartest.File("app1/lib.so", lib),
+		tartest.File("app2/lib.so", lib),
+		tartest.File("app3/lib.so", lib),
+	})
+	options := tar_diff.NewOptions()
+	options.SetFrameSize(64 * 1024)
+	options.SetDedupWindow(1024 * 1024)
+	encodings := make(map[string]tar_diff.FileEncoding)
+	options.SetFileReport(func(report *tar_diff.FileReport) {
+		encodings[report.Path] = report.Encoding
+	})
+	delta := diffAndApply(t, layers, options)
+	if encodings["app3/lib.so"] != tar_diff.EncodingDuplicate {
+		t.Fatalf("Expected app3/lib.so to be copied from earlier output, got %s", encodings["app3/lib.so"])
+	}
+	checkResume(t, delta, layers)
+}
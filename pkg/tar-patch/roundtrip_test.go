@@ -0,0 +1,171 @@
+package tar_patch
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := tartest.RandomData(1, 64*1024)
+	other := tartest.RandomData(2, 64*1024)
+	longName := "dir/" + strings.Repeat("long-directory-name/", 8) + "file.txt"
+	sparse := tartest.Entry{
+		Name:       "dir/sparse",
+		Data:       []byte("PART1\nPART2\n"),
+		Sparse:     []tartest.SparseRegion{{Offset: 0, Length: 6}, {Offset: 1024 * 1024, Length: 6}},
+		SparseSize: 1024*1024 + 6,
+	}
+
+	tests := []struct {
+		name         string
+		old          []tartest.Entry
+		new          []tartest.Entry
+		maxDeltaSize int
+	}{
+		{
+			name:         "unchanged",
+			old:          []tartest.Entry{tartest.Dir("dir"), tartest.File("dir/file", data)},
+			new:          []tartest.Entry{tartest.Dir("dir"), tartest.File("dir/file", data)},
+			maxDeltaSize: 400,
+		},
+		{
+			name:         "rename",
+			old:          []tartest.Entry{tartest.File("dir/bar.txt", data)},
+			new:          []tartest.Entry{tartest.File("dir/bar.TXT", data)},
+			maxDeltaSize: 400,
+		},
+		{
+			name:         "move",
+			old:          []tartest.Entry{tartest.File("dir1/move.txt", data), tartest.File("dir1/other", other)},
+			new:          []tartest.Entry{tartest.File("dir1/other", other), tartest.File("dir2/move.txt", data)},
+			maxDeltaSize: 500,
+		},
+		{
+			name:         "append",
+			old:          []tartest.Entry{tartest.File("file", data)},
+			new:          []tartest.Entry{tartest.File("file", append(append([]byte{}, data...), "appended data\n"...))},
+			maxDeltaSize: 400,
+		},
+		{
+			name:         "truncate",
+			old:          []tartest.Entry{tartest.File("file", data)},
+			new:          []tartest.Entry{tartest.File("file", data[:len(data)/2])},
+			maxDeltaSize: 400,
+		},
+		{
+			name:         "modify",
+			old:          []tartest.Entry{tartest.File("file", data)},
+			new:          []tartest.Entry{tartest.File("file", tartest.Modify(data, 1000))},
+			maxDeltaSize: 1000,
+		},
+		{
+			name:         "new file",
+			old:          []tartest.Entry{tartest.File("file", data)},
+			new:          []tartest.Entry{tartest.File("file", data), tartest.File("new", other)},
+			maxDeltaSize: len(other) + 2000,
+		},
+		{
+			name: "links",
+			old: []tartest.Entry{
+				tartest.File("dir/foo.txt", data),
+				tartest.Symlink("dir/symlink", "foo.txt"),
+				tartest.Symlink("broken", "not-exist"),
+				tartest.Hardlink("dir/hardlink", "dir/foo.txt"),
+			},
+			new: []tartest.Entry{
+				tartest.File("dir/foo.txt", other),
+				tartest.Symlink("dir/symlink", "hardlink"),
+				tartest.Hardlink("dir/hardlink", "dir/foo.txt"),
+				tartest.Hardlink("dir/hardlink2", "dir/foo.txt"),
+			},
+			maxDeltaSize: len(other) + 2000,
+		},
+		{
+			name: "hardlink source",
+			old: []tartest.Entry{
+				tartest.File("a", other),
+				tartest.Hardlink("b", "a"),
+			},
+			new:          []tartest.Entry{tartest.File("b", other)},
+			maxDeltaSize: 400,
+		},
+		{
+			name: "duplicate entries",
+			old: []tartest.Entry{
+				tartest.File("file", other),
+				tartest.File("file", data),
+			},
+			new: []tartest.Entry{
+				tartest.File("file", data),
+				tartest.File("file", tartest.Modify(data, 5000)),
+			},
+			maxDeltaSize: 1000,
+		},
+		{
+			name: "pax headers",
+			old:  []tartest.Entry{{Name: "dir/file", Data: data}},
+			new: []tartest.Entry{
+				{Name: "dir/fïlé", Data: data, Format: tar.FormatPAX},
+				{Name: longName, Data: []byte("long name"), Format: tar.FormatPAX},
+			},
+			maxDeltaSize: 1000,
+		},
+		{
+			name: "gnu headers",
+			old:  []tartest.Entry{{Name: longName, Data: data, Format: tar.FormatGNU}},
+			new: []tartest.Entry{
+				{Name: longName, Data: tartest.Modify(data, 2000), Format: tar.FormatGNU},
+				{Name: longName + ".link", Typeflag: tar.TypeSymlink, Linkname: longName, Format: tar.FormatGNU},
+			},
+			maxDeltaSize: 1000,
+		},
+		{
+			name:         "sparse",
+			old:          []tartest.Entry{sparse, tartest.File("file", data)},
+			new:          []tartest.Entry{tartest.File("file", data), sparse},
+			maxDeltaSize: 1000,
+		},
+		{
+			name:         "unreadable",
+			old:          []tartest.Entry{{Name: "secret", Data: data, Mode: 0200}},
+			new:          []tartest.Entry{{Name: "secret", Data: data, Mode: 0200}},
+			maxDeltaSize: len(data) + 2000,
+		},
+		{
+			name:         "empty",
+			old:          []tartest.Entry{},
+			new:          []tartest.Entry{tartest.File("empty", nil), tartest.Dir("dir")},
+			maxDeltaSize: 400,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layers := tartest.BuildLayers(t, test.old, test.new)
+			delta := diffAndApply(t, layers, nil)
+			if len(delta) > test.maxDeltaSize {
+				t.Errorf("Delta is %d bytes, expected at most %d", len(delta), test.maxDeltaSize)
+			}
+
+			// The same from the extracted old files
+			oldFS := fstest.MapFS{}
+			for name, data := range layers.OldFiles() {
+				oldFS[name] = &fstest.MapFile{Data: data, Mode: 0644}
+			}
+			var fsDelta bytes.Buffer
+			if err := tar_diff.DiffFS(oldFS, bytes.NewReader(layers.New), &fsDelta, nil); err != nil {
+				t.Fatal(err)
+			}
+			if fsDelta.Len() > test.maxDeltaSize {
+				t.Errorf("Delta from files is %d bytes, expected at most %d", fsDelta.Len(), test.maxDeltaSize)
+			}
+			checkApply(t, fsDelta.Bytes(), layers)
+		})
+	}
+}
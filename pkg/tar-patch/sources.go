@@ -0,0 +1,99 @@
+package tar_patch
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/containers/tar-diff/pkg/common"
+)
+
+// Reads the header and delta info at the start of a delta. If the delta
+// has no info, an empty DeltaInfo is returned.
+func ReadDeltaInfo(delta io.Reader) (*common.DeltaInfo, error) {
+	return readDeltaHeader(bufio.NewReader(delta))
+}
+
+type SourceStatus int
+
+const (
+	SourceOK SourceStatus = iota
+	SourceMissing
+	SourceCorrupted // Wrong size or digest
+	SourceUnreadable
+)
+
+func (s SourceStatus) String() string {
+	switch s {
+	case SourceOK:
+		return "ok"
+	case SourceMissing:
+		return "missing"
+	case SourceCorrupted:
+		return "corrupted"
+	case SourceUnreadable:
+		return "unreadable"
+	}
+	return "unknown"
+}
+
+// SourceCheck is the result of checking one of the old files a delta needs
+type SourceCheck struct {
+	Source common.SourceInfo
+	Status SourceStatus
+	Err    error // The error for missing or unreadable files
+}
+
+// Opens a source the same way applying a delta would, by digest if the data source supports it
+func openSource(dataSource DataSource, source *common.SourceInfo) error {
+	if _, ok := dataSource.(DigestDataSource); ok && source.Digest != "" {
+		return openSourceDigest(dataSource, source.Digest)
+	}
+	return openSourceFile(dataSource, source.Path)
+}
+
+// Returns the size and digest of the current file of the data source
+func hashSource(dataSource DataSource) (int64, string, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, dataSource)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func checkSource(dataSource DataSource, source *common.SourceInfo) SourceCheck {
+	check := SourceCheck{Source: *source}
+	if err := openSource(dataSource, source); err != nil {
+		check.Err = err
+		check.Status = SourceUnreadable
+		if errors.Is(err, fs.ErrNotExist) {
+			check.Status = SourceMissing
+		}
+		return check
+	}
+
+	size, digest, err := hashSource(dataSource)
+	if err != nil {
+		check.Err = err
+		check.Status = SourceUnreadable
+	} else if size != source.Size || digest != source.Digest {
+		check.Status = SourceCorrupted
+	}
+	return check
+}
+
+// Checks that all the old files listed in the delta info are available in
+// the data source with the right content. This reads all of them, so it can
+// also be used to prefetch them. Deltas created without a source list
+// return no results.
+func CheckSources(info *common.DeltaInfo, dataSource DataSource) []SourceCheck {
+	checks := make([]SourceCheck, 0, len(info.Sources))
+	for i := range info.Sources {
+		checks = append(checks, checkSource(dataSource, &info.Sources[i]))
+	}
+	return checks
+}
@@ -0,0 +1,107 @@
+package tar_patch
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestCheckSources(t *testing.T) {
+	data := tartest.RandomData(1, 64*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("same", []byte("unchanged file")),
+		tartest.File("modified", data),
+		tartest.File("removed", tartest.RandomData(2, 1000)),
+		tartest.File("unused", tartest.RandomData(3, 1000)),
+	}, []tartest.Entry{
+		tartest.File("same", []byte("unchanged file")),
+		tartest.File("modified", tartest.Modify(data, 1000)),
+		tartest.File("removed.moved", tartest.RandomData(2, 1000)),
+	})
+	delta := makeTestDelta(t, layers.Old, layers.New, 0)
+
+	info, err := ReadDeltaInfo(bytes.NewReader(delta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := layers.OldFiles()
+	files["same"] = []byte("changed file!!")
+	delete(files, "removed")
+
+	expected := map[string]SourceStatus{
+		"same":     SourceCorrupted,
+		"modified": SourceOK,
+		"removed":  SourceMissing,
+	}
+	checks := CheckSources(info, NewMapDataSource(files))
+	if len(checks) != len(expected) {
+		t.Fatalf("Expected %d sources, got %d", len(expected), len(checks))
+	}
+	for _, check := range checks {
+		if check.Status != expected[check.Source.Path] {
+			t.Errorf("%s: expected %s, got %s", check.Source.Path, expected[check.Source.Path], check.Status)
+		}
+	}
+}
+
+func TestVerifySources(t *testing.T) {
+	data := tartest.RandomData(1, 64*1024)
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("dir/a", data),
+		tartest.File("dir/b", tartest.RandomData(2, 32*1024)),
+	}, []tartest.Entry{
+		tartest.File("dir/a", tartest.Modify(data, 3000)),
+		tartest.File("dir/c", tartest.RandomData(2, 32*1024)),
+	})
+
+	for _, frameSize := range []int64{0, 16 * 1024} {
+		delta := makeTestDelta(t, layers.Old, layers.New, frameSize)
+		checkApply(t, delta, layers)
+
+		files := layers.OldFiles()
+		// Same size, so only the digest can tell
+		files["dir/b"] = tartest.Modify(files["dir/b"], 10000)
+		err := Apply(bytes.NewReader(delta), NewMapDataSource(files), ioutil.Discard)
+		var modified *SourceModifiedError
+		if !errors.As(err, &modified) || modified.Path != "dir/b" || !strings.Contains(err.Error(), "dir/b") {
+			t.Errorf("frame size %d: expected dir/b to be reported as modified, got %v", frameSize, err)
+		}
+		err = ApplyResumable(bytes.NewReader(delta), NewMapDataSource(files), ioutil.Discard, nil, nil)
+		if !errors.As(err, &modified) {
+			t.Errorf("frame size %d: expected resumable apply to fail, got %v", frameSize, err)
+		}
+		err = ApplyParallel(bytes.NewReader(delta), int64(len(delta)), func() (DataSource, error) {
+			return NewMapDataSource(files), nil
+		}, &bufferWriterAt{}, 2)
+		if !errors.As(err, &modified) {
+			t.Errorf("frame size %d: expected parallel apply to fail, got %v", frameSize, err)
+		}
+
+		if frameSize != 0 {
+			err = ApplyRange(bytes.NewReader(delta), int64(len(delta)), NewMapDataSource(files), 0, int64(len(layers.New)), ioutil.Discard)
+			if !errors.As(err, &modified) {
+				t.Errorf("expected range apply to fail, got %v", err)
+			}
+			r, err := NewReader(bytes.NewReader(delta), int64(len(delta)), NewMapDataSource(files))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = r.ReadAt(make([]byte, r.Size()), 0)
+			if !errors.As(err, &modified) {
+				t.Errorf("expected reader to fail, got %v", err)
+			}
+		}
+
+		options := NewApplyOptions()
+		options.SetVerifySources(false)
+		// The modified file is used, but the output is still checked
+		err = ApplyWithOptions(bytes.NewReader(delta), NewMapDataSource(files), ioutil.Discard, options)
+		if err == nil || errors.As(err, &modified) || !strings.Contains(err.Error(), "Reconstructed tarfile doesn't match") {
+			t.Errorf("frame size %d: expected the output digest to mismatch without verification, got %v", frameSize, err)
+		}
+	}
+}
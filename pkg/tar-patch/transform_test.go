@@ -0,0 +1,51 @@
+package tar_patch
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/containers/tar-diff/pkg/tar-diff"
+	"github.com/containers/tar-diff/pkg/tartest"
+)
+
+func TestApplyTransform(t *testing.T) {
+	layers := tartest.BuildLayers(t, []tartest.Entry{
+		tartest.File("usr/bin/prog", tartest.FakeExecutable(1, 0)),
+	}, []tartest.Entry{
+		tartest.File("usr/bin/prog", tartest.FakeExecutable(1, 1000)),
+	})
+
+	for _, frameSize := range []int64{0, 16 * 1024} {
+		options := tar_diff.NewOptions()
+		options.SetFrameSize(frameSize)
+		options.SetTransformExecutables(true)
+		delta := diffAndApply(t, layers, options)
+
+		if frameSize != 0 {
+			for _, r := range [][2]int64{{0, 100}, {600, 5000}, {int64(len(layers.New)) - 3000, 3000}} {
+				var part bytes.Buffer
+				if err := ApplyRange(bytes.NewReader(delta), int64(len(delta)), NewMapDataSource(layers.OldFiles()), r[0], r[1], &part); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(part.Bytes(), layers.New[r[0]:r[0]+r[1]]) {
+					t.Errorf("Wrong output for range %d+%d", r[0], r[1])
+				}
+			}
+		}
+
+		// Ops inside the transform are skipped when the source is missing
+		applyOptions := NewApplyOptions()
+		applyOptions.SetFallbackFetcher(NewReaderAtFallbackFetcher(bytes.NewReader(layers.New)))
+		var out bytes.Buffer
+		if err := ApplyWithOptions(bytes.NewReader(delta), NewMapDataSource(nil), &out, applyOptions); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), layers.New) {
+			t.Errorf("frame size %d: wrong output with fallback", frameSize)
+		}
+		if err := Apply(bytes.NewReader(delta), NewMapDataSource(nil), ioutil.Discard); err == nil {
+			t.Errorf("frame size %d: expected error with missing source", frameSize)
+		}
+	}
+}
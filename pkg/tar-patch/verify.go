@@ -0,0 +1,106 @@
+package tar_patch
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containers/tar-diff/pkg/common"
+)
+
+// SourceDigester can be implemented by data sources that can find the
+// digest of the current file without reading all of it, for example
+// from a cache.
+type SourceDigester interface {
+	// Returns the digest of the current file, like "sha256:<hex>", or "" if it's not known
+	CurrentFileDigest() (string, error)
+	// Called with the digest of the current file after it was hashed
+	CacheCurrentFileDigest(digest string)
+}
+
+// SourceModifiedError is returned when a source file doesn't have the
+// content it had when the delta was created
+type SourceModifiedError struct {
+	Path     string
+	Expected string
+	Actual   string
+}
+
+func (e *SourceModifiedError) Error() string {
+	return fmt.Sprintf("Source file %s has been modified since the delta was created (expected digest %s, got %s)", e.Path, e.Expected, e.Actual)
+}
+
+// Verifies each source file listed in the delta info the first time it's opened
+type sourceVerifier struct {
+	sources map[string]*common.SourceInfo // By path and by digest
+	checked map[string]error              // The result of verifying each path or digest
+}
+
+// Returns nil if the delta has no list of sources to verify against
+func newSourceVerifier(info *common.DeltaInfo) *sourceVerifier {
+	if len(info.Sources) == 0 {
+		return nil
+	}
+	v := &sourceVerifier{
+		sources: make(map[string]*common.SourceInfo),
+		checked: make(map[string]error),
+	}
+	for i := range info.Sources {
+		source := &info.Sources[i]
+		v.sources[source.Path] = source
+		if source.Digest != "" {
+			v.sources[source.Digest] = source
+		}
+	}
+	return v
+}
+
+// Verifies the just opened current file of dataSource, which was opened by
+// the path or digest key. This leaves the file at position 0.
+func (v *sourceVerifier) verify(dataSource DataSource, key string) error {
+	if v == nil {
+		return nil
+	}
+	if err, ok := v.checked[key]; ok {
+		return err
+	}
+	err := v.check(dataSource, key)
+	// Read errors might be temporary, so only remember the content checks
+	if _, ok := err.(*SourceModifiedError); ok || err == nil {
+		v.checked[key] = err
+	}
+	return err
+}
+
+func (v *sourceVerifier) check(dataSource DataSource, key string) error {
+	source := v.sources[key]
+	if source == nil {
+		return fmt.Errorf("Delta uses source file %s, which is not in its list of sources", key)
+	}
+
+	digester, _ := dataSource.(SourceDigester)
+	digest := ""
+	if digester != nil {
+		var err error
+		digest, err = digester.CurrentFileDigest()
+		if err != nil {
+			return err
+		}
+	}
+	if digest == "" {
+		_, hashed, err := hashSource(dataSource)
+		if err != nil {
+			return fmt.Errorf("Error reading source file %s: %v", source.Path, err)
+		}
+		if _, err := dataSource.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if digester != nil {
+			digester.CacheCurrentFileDigest(hashed)
+		}
+		digest = hashed
+	}
+	if digest != source.Digest {
+		return &SourceModifiedError{Path: source.Path, Expected: source.Digest, Actual: digest}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package tar_patch
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	fsIocMeasureVerity  = 0xc0046686
+	maxVerityDigestSize = 64
+)
+
+// Returns the fs-verity digest of f, as "<algorithm>-<hex>", or "" if it
+// doesn't have verity enabled
+func measureVerity(fd uintptr) string {
+	var buf struct {
+		algorithm uint16
+		size      uint16
+		digest    [maxVerityDigestSize]byte
+	}
+	buf.size = maxVerityDigestSize
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, fsIocMeasureVerity, uintptr(unsafe.Pointer(&buf)))
+	if errno != 0 || buf.size > maxVerityDigestSize {
+		return ""
+	}
+	return fmt.Sprintf("%d-%s", buf.algorithm, hex.EncodeToString(buf.digest[:buf.size]))
+}
+
+// Files with fs-verity enabled can't be modified or truncated, so they are
+// safe to map into memory
+func isImmutable(file *os.File) bool {
+	return measureVerity(file.Fd()) != ""
+}
+
+// Returns the digest cached for a file with fs-verity enabled, if any.
+// As verity files are immutable, a digest computed for the same verity
+// digest is still valid.
+func (f *FilesystemDataSource) CurrentFileDigest() (string, error) {
+	if f.current == nil {
+		return "", nil
+	}
+	verity := measureVerity(f.current.file.Fd())
+	if verity == "" {
+		return "", nil
+	}
+	return cachedVerityDigest(f.options.digestDir, verity), nil
+}
+
+// Caches the digest for files with fs-verity enabled
+func (f *FilesystemDataSource) CacheCurrentFileDigest(digest string) {
+	if f.current == nil {
+		return
+	}
+	verity := measureVerity(f.current.file.Fd())
+	if verity == "" {
+		return
+	}
+	cacheVerityDigest(f.options.digestDir, verity, digest)
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package tar_patch
+
+import (
+	"os"
+)
+
+// Without fs-verity, files can always be truncated while they are used
+func isImmutable(file *os.File) bool {
+	return false
+}
+
+// fs-verity is only supported on Linux, so there is no cached digest
+func (f *FilesystemDataSource) CurrentFileDigest() (string, error) {
+	return "", nil
+}
+
+func (f *FilesystemDataSource) CacheCurrentFileDigest(digest string) {
+}
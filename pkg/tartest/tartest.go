@@ -0,0 +1,364 @@
+// Package tartest builds tarfiles for tests
+package tartest
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// TB is the part of testing.TB used by the helpers, so that importing this
+// package doesn't register the testing flags
+type TB interface {
+	Helper()
+	Fatal(args ...interface{})
+}
+
+// Entry describes an entry in a generated tarfile
+type Entry struct {
+	Name     string
+	Typeflag byte  // Defaults to tar.TypeReg
+	Mode     int64 // Defaults to 0644, or 0755 for directories
+	Data     []byte
+	Linkname string
+	Format   tar.Format // Defaults to whatever archive/tar picks
+	ModTime  time.Time  // Defaults to a fixed time
+
+	// If non-nil, the entry is written as a PAX (1.0) sparse file of size
+	// SparseSize, with Data holding the content of the regions in the map
+	Sparse     []SparseRegion
+	SparseSize int64
+}
+
+// SparseRegion is a region with data in a sparse file, the rest is holes
+type SparseRegion struct {
+	Offset int64
+	Length int64
+}
+
+var defaultModTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func File(name string, data []byte) Entry {
+	return Entry{Name: name, Data: data}
+}
+
+func Dir(name string) Entry {
+	return Entry{Name: name, Typeflag: tar.TypeDir}
+}
+
+func Symlink(name string, target string) Entry {
+	return Entry{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}
+}
+
+func Hardlink(name string, target string) Entry {
+	return Entry{Name: name, Typeflag: tar.TypeLink, Linkname: target}
+}
+
+// Returns size bytes of random data, which is the same for the same seed
+func RandomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// Returns a copy of data with every stride'th byte changed
+func Modify(data []byte, stride int) []byte {
+	modified := append([]byte{}, data...)
+	for i := 0; i < len(modified); i += stride {
+		modified[i]++
+	}
+	return modified
+}
+
+// Creates a fake x86-64 executable where all functions call the first few,
+// like runtime functions. Extra code of insertSize bytes is inserted after
+// them, so that most call offsets change.
+func FakeExecutable(seed int64, insertSize int) []byte {
+	const nFunctions = 200
+	r := rand.New(rand.NewSource(seed))
+	bodies := make([][]byte, nFunctions)
+	for i := range bodies {
+		bodies[i] = RandomData(seed+int64(i), 100+r.Intn(400))
+	}
+	offsets := make([]int, nFunctions)
+	pos := 64
+	for i := range bodies {
+		offsets[i] = pos
+		pos += len(bodies[i])
+		if i == 3 {
+			pos += insertSize
+		}
+	}
+
+	header := make([]byte, 64)
+	copy(header, "\x7fELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(header[18:], 62)
+	data := append([]byte{}, header...)
+	for i, body := range bodies {
+		body = append([]byte{}, body...)
+		for at := 0; at+5 <= len(body); at += 16 {
+			target := offsets[(i+at)%4]
+			body[at] = 0xe8
+			binary.LittleEndian.PutUint32(body[at+1:], uint32(target-(offsets[i]+at+5)))
+		}
+		data = append(data, body...)
+		if i == 3 {
+			data = append(data, RandomData(seed+1000, insertSize)...)
+		}
+	}
+	return data
+}
+
+func (e *Entry) header() *tar.Header {
+	hdr := &tar.Header{
+		Name:     e.Name,
+		Typeflag: e.Typeflag,
+		Mode:     e.Mode,
+		Linkname: e.Linkname,
+		ModTime:  e.ModTime,
+		Format:   e.Format,
+	}
+	if hdr.Typeflag == 0 {
+		hdr.Typeflag = tar.TypeReg
+	}
+	if hdr.Mode == 0 && hdr.Typeflag == tar.TypeDir {
+		hdr.Mode = 0755
+	} else if hdr.Mode == 0 {
+		hdr.Mode = 0644
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = defaultModTime
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		hdr.Size = int64(len(e.Data))
+	}
+	return hdr
+}
+
+// Writes a header with the given typeflag, which archive/tar doesn't allow us to write directly
+func writeRawHeader(buf *bytes.Buffer, w *tar.Writer, name string, typeflag byte, data []byte) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	start := buf.Len()
+	hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data)), ModTime: defaultModTime, Format: tar.FormatUSTAR}
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	// The header is written out immediately, so we can patch it in place
+	block := buf.Bytes()[start : start+512]
+	block[156] = typeflag
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, b := range block {
+		sum += int(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	_, err := w.Write(data)
+	return err
+}
+
+func paxRecord(key, value string) string {
+	// The length includes the length field itself
+	rest := " " + key + "=" + value + "\n"
+	size := len(rest) + 1
+	for len(strconv.Itoa(size))+len(rest) != size {
+		size++
+	}
+	return strconv.Itoa(size) + rest
+}
+
+func writeSparse(buf *bytes.Buffer, w *tar.Writer, e *Entry) error {
+	dir, file := path.Split(e.Name)
+	records := paxRecord("GNU.sparse.major", "1") +
+		paxRecord("GNU.sparse.minor", "0") +
+		paxRecord("GNU.sparse.name", e.Name) +
+		paxRecord("GNU.sparse.realsize", strconv.FormatInt(e.SparseSize, 10))
+	if err := writeRawHeader(buf, w, dir+"PaxHeaders.0/"+file, tar.TypeXHeader, []byte(records)); err != nil {
+		return err
+	}
+
+	sparseMap := strconv.Itoa(len(e.Sparse)) + "\n"
+	for _, region := range e.Sparse {
+		sparseMap += strconv.FormatInt(region.Offset, 10) + "\n" + strconv.FormatInt(region.Length, 10) + "\n"
+	}
+	if pad := len(sparseMap) % 512; pad != 0 {
+		sparseMap += string(make([]byte, 512-pad))
+	}
+
+	hdr := e.header()
+	hdr.Name = dir + "GNUSparseFile.0/" + file
+	hdr.Size = int64(len(sparseMap) + len(e.Data))
+	hdr.Format = tar.FormatUSTAR
+	if err := w.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, sparseMap); err != nil {
+		return err
+	}
+	_, err := w.Write(e.Data)
+	return err
+}
+
+// Builds a tarfile with the given entries, in order
+func Build(entries []Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for i := range entries {
+		e := &entries[i]
+		if e.Sparse != nil {
+			if err := writeSparse(&buf, w, e); err != nil {
+				return nil, fmt.Errorf("Can't write %s: %v", e.Name, err)
+			}
+			continue
+		}
+		if err := w.WriteHeader(e.header()); err != nil {
+			return nil, fmt.Errorf("Can't write %s: %v", e.Name, err)
+		}
+		if len(e.Data) > 0 {
+			if _, err := w.Write(e.Data); err != nil {
+				return nil, fmt.Errorf("Can't write %s: %v", e.Name, err)
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func cleanPath(name string) string {
+	return path.Clean("/" + name)[1:]
+}
+
+// Returns the content of the regular files in a tarfile, by path, as if it
+// was extracted. Later entries replace earlier ones, and hardlinks get the
+// content of their target.
+func Extract(tarData []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	r := tar.NewReader(bytes.NewReader(tarData))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := cleanPath(hdr.Name)
+		delete(files, name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			files[name] = data
+		case tar.TypeLink:
+			if data, ok := files[cleanPath(hdr.Linkname)]; ok {
+				files[name] = data
+			}
+		}
+	}
+	return files, nil
+}
+
+// Layers is an old and a new tarfile to diff, with the files of the old
+// one as extracted
+type Layers struct {
+	Old   []byte
+	New   []byte
+	files map[string][]byte
+}
+
+// Builds the old and new tarfiles, failing the test on errors
+func BuildLayers(t TB, old []Entry, new []Entry) *Layers {
+	t.Helper()
+	oldTar, err := Build(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTar, err := Build(new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewLayers(t, oldTar, newTar)
+}
+
+// Like BuildLayers, for tarfiles that are already built
+func NewLayers(t TB, oldTar []byte, newTar []byte) *Layers {
+	t.Helper()
+	files, err := Extract(oldTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Layers{Old: oldTar, New: newTar, files: files}
+}
+
+// Returns the extracted old files. This is a new map each time, so tests
+// can remove or replace files in it.
+func (l *Layers) OldFiles() map[string][]byte {
+	files := make(map[string][]byte, len(l.files))
+	for name, data := range l.files {
+		files[name] = data
+	}
+	return files
+}
+
+// Writes the extracted old files to dir, for data sources that read from
+// the filesystem
+func (l *Layers) WriteOldFiles(t TB, dir string) {
+	t.Helper()
+	for name, data := range l.files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// DiffFunc creates a delta from the old to the new tarfile
+type DiffFunc func(oldTar io.ReadSeeker, newTar io.ReadSeeker, delta io.Writer) error
+
+// ApplyFunc recreates the new tarfile from a delta and the extracted old
+// files. This package can't use tar-diff and tar-patch itself, as their
+// tests import it.
+type ApplyFunc func(delta io.Reader, oldFiles map[string][]byte, dst io.Writer) error
+
+// Diffs the layers, and checks that applying the delta recreates the new
+// tarfile
+func (l *Layers) DiffAndApply(t TB, diff DiffFunc, apply ApplyFunc) []byte {
+	t.Helper()
+	var delta bytes.Buffer
+	if err := diff(bytes.NewReader(l.Old), bytes.NewReader(l.New), &delta); err != nil {
+		t.Fatal(err)
+	}
+	l.CheckApply(t, delta.Bytes(), apply)
+	return delta.Bytes()
+}
+
+// Checks that applying the delta to the old files recreates the new tarfile
+func (l *Layers) CheckApply(t TB, delta []byte, apply ApplyFunc) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := apply(bytes.NewReader(delta), l.OldFiles(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), l.New) {
+		t.Fatal("Output doesn't match the new tarfile")
+	}
+}
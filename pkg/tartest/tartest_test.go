@@ -0,0 +1,45 @@
+package tartest
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+)
+
+func TestSparse(t *testing.T) {
+	tarData, err := Build([]Entry{
+		File("before", []byte("before")),
+		{
+			Name:       "dir/sparse",
+			Data:       []byte("PART1PART2"),
+			Sparse:     []SparseRegion{{Offset: 0, Length: 5}, {Offset: 10000, Length: 5}},
+			SparseSize: 10005,
+		},
+		File("after", []byte("after")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := tar.NewReader(bytes.NewReader(tarData[1024:])).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.PAXRecords["GNU.sparse.major"] != "1" {
+		t.Errorf("Not a PAX sparse file: %v", hdr.PAXRecords)
+	}
+
+	files, err := Extract(tarData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make([]byte, 10005)
+	copy(expected, "PART1")
+	copy(expected[10000:], "PART2")
+	if !bytes.Equal(files["dir/sparse"], expected) {
+		t.Error("Wrong sparse file content")
+	}
+	if string(files["after"]) != "after" {
+		t.Error("Wrong content after sparse file")
+	}
+}
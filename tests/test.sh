@@ -1,5 +1,8 @@
 #!/bin/bash
 
+# Most round-trip cases are covered by the Go tests (see pkg/tartest), this
+# checks the command line tools with tarfiles created by GNU tar, gzip and bzip2.
+
 set -e
 
 TEST_DIR=$(mktemp -d /tmp/test-tardiff-XXXXXX)